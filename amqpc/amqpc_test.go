@@ -0,0 +1,375 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func memClient(t *testing.T, b *memBroker, queue string, prefetch int) *amqpClient {
+	c, err := openClient(b.Dial(), queue, prefetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// TestSendReceive sends the args with sender.SendAll, and receives them
+// with consumer.Prepare and Handle, as pub and sub do.
+func TestSendReceive(t *testing.T) {
+	b := newMemBroker()
+	dir, err := ioutil.TempDir("", "amqpc-mem-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "a.txt")
+	if err := ioutil.WriteFile(fn, []byte(strings.Repeat("hello world ", 1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the handler gets the file with its original name, and the same content
+	same := []string{"sh", "-c", `test "$(basename "$1")" = a.txt && cmp "$1" ` + fn, "-"}
+
+	for _, tc := range []struct {
+		name, compress string
+		chunkSize      int
+		args           []string
+		handler        []string
+		// messages is the number of messages published
+		messages int
+		encoding string
+		// exitCode is the handler's, 0 if it succeeds (and nothing is dead-lettered)
+		exitCode int
+	}{
+		{name: "gzip", compress: "gzip", chunkSize: 1 << 20, args: []string{"@" + fn}, handler: same, messages: 1, encoding: "gzip"},
+		{name: "none", compress: "none", chunkSize: 1 << 20, args: []string{"@" + fn}, handler: same, messages: 1},
+		{name: "auto", compress: "auto", chunkSize: 1 << 20, args: []string{"@" + fn}, handler: same, messages: 1, encoding: "gzip"},
+		{name: "chunked", compress: "none", chunkSize: 1000, args: []string{"@" + fn}, handler: same, messages: 12},
+		{name: "text", compress: "auto", chunkSize: 1 << 20, args: []string{"plain text"}, handler: []string{"grep", "-q", "^plain text$"}, messages: 1},
+		{name: "fail", compress: "auto", chunkSize: 1 << 20, args: []string{"x"}, handler: []string{"sh", "-c", "exit 3"}, messages: 1, exitCode: 3},
+		{name: "chunked-fail", compress: "none", chunkSize: 1000, args: []string{"@" + fn}, handler: []string{"false"}, messages: 12, exitCode: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := "q-" + tc.name
+			replies := q + ".replies"
+			c := memClient(t, b, q, 1)
+			if _, err := c.QueueDeclare(replies, false, false, false, false, nil); err != nil {
+				t.Fatal(err)
+			}
+			snd := sender{Key: q, Compress: tc.compress, ChunkSize: tc.chunkSize, AppID: "test",
+				Replies: &replyWaiter{Queue: replies, pending: make(map[string]string)}}
+			pb, err := snd.SendAll(c, spool{}, time.Second, tc.args, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rs := pb.Results(); len(rs) != 1 || rs[0].Status() != "delivered" || rs[0].Messages != tc.messages {
+				t.Fatalf("got %+v", rs)
+			}
+			msgs := b.Messages(q)
+			if pb.Delivered != tc.messages || len(msgs) != tc.messages {
+				t.Fatalf("delivered %d, queued %d, wanted %d", pb.Delivered, len(msgs), tc.messages)
+			}
+			if msgs[0].ContentEncoding != tc.encoding {
+				t.Errorf("got encoding %q, wanted %q", msgs[0].ContentEncoding, tc.encoding)
+			}
+			if strings.HasPrefix(tc.args[0], "@") && headerString(msgs[0].Headers["FileName"]) != fn {
+				t.Errorf("got FileName %q, wanted %q", msgs[0].Headers["FileName"], fn)
+			}
+
+			c = memClient(t, b, q, 1)
+			defer c.Close()
+			chunks := chunkStore{Dir: filepath.Join(dir, "chunks"), Timeout: time.Hour}
+			rt, err := newRetrier(c, q, retryPolicy{MaxAttempts: 2, Delay: 50 * time.Millisecond, DeadLetterQueue: q + ".dead"}, chunks, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cs := consumer{Receiver: receiver{Args: tc.handler}, Retrier: rt, Chunks: chunks}
+			d, err := c.Consume(q, "", false, false, false, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wd := filepath.Join(dir, "w-"+tc.name)
+			if err := os.MkdirAll(wd, 0700); err != nil {
+				t.Fatal(err)
+			}
+			// handle till the first success, or the last attempt
+			var seq uint64
+			deadline := time.After(5 * time.Second)
+			for attempts := 0; attempts < 2; {
+				select {
+				case msg := <-d:
+					seq++
+					j, ok, err := cs.Prepare(msg, seq)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !ok {
+						continue
+					}
+					if err := cs.Handle(j, wd); err != nil {
+						t.Fatal(err)
+					}
+					if attempts++; tc.exitCode == 0 {
+						attempts = 2
+					}
+				case <-deadline:
+					t.Fatal("timeout")
+				}
+			}
+
+			if n := len(b.Messages(q)); n != 0 {
+				t.Errorf("%d messages are left in the queue", n)
+			}
+			if fis, _ := ioutil.ReadDir(wd); len(fis) != 0 {
+				t.Errorf("%d files are left in the worker's directory", len(fis))
+			}
+			dead := b.Messages(q + ".dead")
+			if tc.exitCode == 0 {
+				if len(dead) != 0 {
+					t.Errorf("%d messages are dead-lettered", len(dead))
+				}
+			} else {
+				// a transfer is dead-lettered chunk by chunk
+				if len(dead) != tc.messages {
+					t.Fatalf("got %d dead-lettered messages, wanted %d", len(dead), tc.messages)
+				}
+				if code, _ := headerInt(dead[0].Headers[hdrExitCode]); int(code) != tc.exitCode {
+					t.Errorf("got exit code %v, wanted %d", dead[0].Headers[hdrExitCode], tc.exitCode)
+				}
+				if attempts, _ := headerInt(dead[0].Headers[hdrAttempts]); attempts != 2 {
+					t.Errorf("got %d attempts, wanted 2", attempts)
+				}
+			}
+
+			// only the final outcome is replied to
+			rs := b.Messages(replies)
+			if len(rs) != 1 {
+				t.Fatalf("got %d replies, wanted 1", len(rs))
+			}
+			var reply rpcReply
+			if err := json.Unmarshal(rs[0].Body, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply.ExitCode != tc.exitCode || rs[0].CorrelationId != msgs[0].CorrelationId {
+				t.Errorf("got reply %+v (%q), wanted exit code %d (%q)", reply, rs[0].CorrelationId, tc.exitCode, msgs[0].CorrelationId)
+			}
+			if tc.exitCode != 0 && reply.Attempt != 2 {
+				t.Errorf("reply to attempt %d, wanted 2", reply.Attempt)
+			}
+		})
+	}
+}
+
+// TestRetryOtherUser retries and dead-letters a message published by an other user
+// than the consumer's: the broker rejects a republished user ID of an other user.
+func TestRetryOtherUser(t *testing.T) {
+	b := newMemBroker()
+	dir, err := ioutil.TempDir("", "amqpc-mem-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q := "q-user"
+	pc, err := openClient(b.DialUser("alice"), q, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.Publish("", q, false, false, amqp.Publishing{UserId: "alice", MessageId: "m1", Body: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	pc.Close()
+
+	c, err := openClient(b.DialUser("bob"), q, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	chunks := chunkStore{Dir: filepath.Join(dir, "chunks"), Timeout: time.Hour}
+	rt, err := newRetrier(c, q, retryPolicy{MaxAttempts: 2, Delay: 50 * time.Millisecond, DeadLetterQueue: q + ".dead"}, chunks, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := consumer{Receiver: receiver{Args: []string{"false"}}, Retrier: rt, Chunks: chunks}
+	handleN(t, c, cs, q, dir, 2)
+	dead := b.Messages(q + ".dead")
+	if len(dead) != 1 {
+		t.Fatalf("got %d dead-lettered messages, wanted 1", len(dead))
+	}
+	if dead[0].UserId != "" || headerString(dead[0].Headers[hdrOriginalUserID]) != "alice" {
+		t.Errorf("got user ID %q, %s=%v", dead[0].UserId, hdrOriginalUserID, dead[0].Headers[hdrOriginalUserID])
+	}
+}
+
+// TestOutputDirFailure checks that the files of a failed handler
+// don't pile up in the output directory through the retries.
+func TestOutputDirFailure(t *testing.T) {
+	b := newMemBroker()
+	dir, err := ioutil.TempDir("", "amqpc-mem-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q := "q-output"
+	c := memClient(t, b, q, 1)
+	defer c.Close()
+	if err := c.Publish("", q, false, false, amqp.Publishing{MessageId: "m1", Headers: amqp.Table{"FileName": "a.txt"}, Body: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	chunks := chunkStore{Dir: filepath.Join(dir, "chunks"), Timeout: time.Hour}
+	rt, err := newRetrier(c, q, retryPolicy{MaxAttempts: 3, Delay: 50 * time.Millisecond, DeadLetterQueue: q + ".dead"}, chunks, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := parseNameTemplate("{{.FileName}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	cs := consumer{Receiver: receiver{Args: []string{"false"}, Sidecar: true}, Retrier: rt, Chunks: chunks,
+		OutputDir: out, NameTemplate: tmpl}
+	handleN(t, c, cs, q, dir, 3)
+	if fis, _ := ioutil.ReadDir(out); len(fis) != 0 {
+		t.Errorf("%d files are left in the output directory", len(fis))
+	}
+	if n := len(b.Messages(q + ".dead")); n != 1 {
+		t.Errorf("got %d dead-lettered messages, wanted 1", n)
+	}
+}
+
+// handleN consumes queue with cs, till n messages are handled.
+func handleN(t *testing.T, c *amqpClient, cs consumer, queue, dir string, n int) {
+	d, err := c.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.After(5 * time.Second)
+	for seq := uint64(1); seq <= uint64(n); seq++ {
+		select {
+		case msg := <-d:
+			j, _, err := cs.Prepare(msg, seq)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cs.Handle(j, dir); err != nil {
+				t.Fatal(err)
+			}
+		case <-deadline:
+			t.Fatal("timeout")
+		}
+	}
+}
+
+// TestRetrierLateConfirm checks that a late confirmation of a timed out publishing
+// is not taken for the confirmation of the next one.
+func TestRetrierLateConfirm(t *testing.T) {
+	b := newMemBroker()
+	c := memClient(t, b, "q-late", 1)
+	defer c.Close()
+	rt, err := newRetrier(c, "q-late", retryPolicy{MaxAttempts: 1}, chunkStore{}, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first publishing has timed out, its ACK comes late; the second one is NACKed
+	confirms := make(chan amqp.Confirmation, 2)
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: false}
+	rt.confirms, rt.seq = confirms, 1
+	if err := rt.Publish("", "q-late", amqp.Publishing{Body: []byte("x")}); err == nil || !strings.Contains(err.Error(), "NACK") {
+		t.Errorf("got %v, wanted NACK", err)
+	}
+	// no confirmation at all
+	if err := rt.Publish("", "q-late", amqp.Publishing{Body: []byte("y")}); err == nil {
+		t.Error("no error without confirmation")
+	}
+}
+
+// TestPubResults checks the counting of the confirmations per input.
+func TestPubResults(t *testing.T) {
+	b := newMemBroker()
+	dir, err := ioutil.TempDir("", "amqpc-mem-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "a.txt")
+	if err := ioutil.WriteFile(fn, []byte(strings.Repeat("hello world ", 1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	type result struct {
+		status                                 string
+		messages, delivered, spooled, returned int
+	}
+	for _, tc := range []struct {
+		name    string
+		snd     sender
+		offline bool
+		args    []string
+		want    []result
+	}{
+		{name: "routable", snd: sender{Key: "q-res", Compress: "none", ChunkSize: 1000, Retries: 1},
+			args: []string{"@" + fn, "text", "@" + missing},
+			want: []result{{"delivered", 12, 12, 0, 0}, {"delivered", 1, 1, 0, 0}, {"failed", 0, 0, 0, 0}},
+		},
+		// returned, and republished once
+		{name: "unroutable", snd: sender{Exchange: "amq.direct", Key: "nowhere", Compress: "none", ChunkSize: 1000, Retries: 1},
+			args: []string{"@" + fn, "text"},
+			want: []result{{"failed", 12, 0, 0, 12}, {"failed", 1, 0, 0, 1}},
+		},
+		{name: "offline", snd: sender{Key: "q-res", Compress: "none", ChunkSize: 1000}, offline: true,
+			args: []string{"@" + fn, "text"},
+			want: []result{{"spooled", 12, 0, 12, 0}, {"spooled", 1, 0, 1, 0}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var c *amqpClient
+			if !tc.offline {
+				c = memClient(t, b, "q-res", 1)
+			}
+			sp := spool{Dir: filepath.Join(dir, "spool-"+tc.name)}
+			pb, err := tc.snd.SendAll(c, sp, time.Second, tc.args, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs := pb.Results()
+			var buf bytes.Buffer
+			printResults(&buf, rs)
+			t.Log("\n" + buf.String())
+			if len(rs) != len(tc.want) {
+				t.Fatalf("got %d results, wanted %d", len(rs), len(tc.want))
+			}
+			for i, r := range rs {
+				got := result{r.Status(), r.Messages, r.Delivered, r.Spooled, r.Returned}
+				if got != tc.want[i] {
+					t.Errorf("%d. got %+v, wanted %+v", i, got, tc.want[i])
+				}
+				if tc.want[i].returned != 0 && r.Retried != tc.want[i].returned {
+					t.Errorf("%d. got %d retries, wanted %d", i, r.Retried, tc.want[i].returned)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,484 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+// Headers of the batches.
+//
+// Every page of a batch is a message of its own, with the batch's ID,
+// its sequence number and the number of pages; then comes the manifest.
+const (
+	hdrBatchID       = "BatchId"
+	hdrBatchSeq      = "BatchSeq"
+	hdrBatchCount    = "BatchCount"
+	hdrBatchManifest = "BatchManifest"
+)
+
+// batchManifest is the body of the manifest message, which closes a batch.
+type batchManifest struct {
+	BatchID string      `json:"batchId"`
+	Items   []batchItem `json:"items"`
+}
+
+// batchItem is a page of a batch.
+type batchItem struct {
+	Seq  int    `json:"seq"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// ContentSha256 is the hash of the page's content (see hdrContentHash),
+	// so the pages are checked against the (signed) manifest.
+	ContentSha256 string `json:"contentSha256"`
+}
+
+// expandBatch returns the files of the args: @FILE, @DIR (its regular files, except
+// the ones matching defaultIgnorePatterns) or @GLOB, each directory and glob in name order.
+func expandBatch(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") || arg == "@-" {
+			return nil, errgo.Newf("a batch needs @FILE, @DIR or @GLOB arguments, got %q", arg)
+		}
+		path := arg[1:]
+		var matches []string
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			fis, err := ioutil.ReadDir(path)
+			if err != nil {
+				return nil, err
+			}
+			for _, fi := range fis {
+				if fi.Mode().IsRegular() && !ignored(fi.Name(), defaultIgnorePatterns) {
+					matches = append(matches, filepath.Join(path, fi.Name()))
+				}
+			}
+		} else if err == nil {
+			matches = []string{path}
+		} else if matches, err = filepath.Glob(path); err != nil {
+			return nil, errgo.Notef(err, "glob %q", path)
+		} else {
+			sort.Strings(matches)
+			j := 0
+			for _, m := range matches {
+				if fi, err := os.Stat(m); err == nil && fi.Mode().IsRegular() {
+					matches[j] = m
+					j++
+				}
+			}
+			matches = matches[:j]
+		}
+		if len(matches) == 0 {
+			return nil, errgo.Newf("%q matches no file", path)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// SendBatch publishes the files of args (see expandBatch) as a batch:
+// each file as a page with the batch headers, then if all the pages are delivered
+// (or spooled), the manifest listing them.
+//
+// Only the manifest waits for a reply, and it has the MessageID, if set.
+func (s sender) SendBatch(pb *publisher, args []string) error {
+	files, err := expandBatch(args)
+	if err != nil {
+		return err
+	}
+	batchID, err := newID()
+	if err != nil {
+		return err
+	}
+	log.Printf("Sending %d files as batch %s.", len(files), batchID)
+	m := batchManifest{BatchID: batchID, Items: make([]batchItem, len(files))}
+	ps := s
+	ps.Replies, ps.MessageID = nil, ""
+	for i, fn := range files {
+		m.Items[i] = batchItem{Seq: i, Name: filepath.Base(fn)}
+		if fi, err := os.Stat(fn); err == nil {
+			m.Items[i].Size = fi.Size()
+		}
+		ps.Headers = make(amqp.Table, len(s.Headers)+3)
+		for k, v := range s.Headers {
+			ps.Headers[k] = v
+		}
+		ps.Headers[hdrBatchID] = batchID
+		ps.Headers[hdrBatchSeq] = int32(i)
+		ps.Headers[hdrBatchCount] = int32(len(files))
+		arg := "@" + fn
+		pb.Begin(arg)
+		if m.Items[i].ContentSha256, err = ps.send(pb, arg); err != nil {
+			log.Printf("Send %q: %v", arg, err)
+			pb.Fail(arg, err)
+		}
+	}
+	if err := pb.Flush(); err != nil {
+		return err
+	}
+
+	item := "batch " + batchID
+	pb.Begin(item)
+	for _, r := range pb.Results() {
+		if r.Item != item && r.Status() == "failed" {
+			err := errgo.Newf("%q is not delivered, the manifest is not sent", r.Item)
+			pb.Fail(item, err)
+			return nil
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tbl := make(amqp.Table, len(s.Headers)+3)
+	for k, v := range s.Headers {
+		tbl[k] = v
+	}
+	tbl[hdrBatchID] = batchID
+	tbl[hdrBatchCount] = int32(len(files))
+	tbl[hdrBatchManifest] = true
+	pub := amqp.Publishing{
+		Headers:       tbl,
+		DeliveryMode:  amqp.Persistent,
+		ContentType:   "application/json",
+		AppId:         s.AppID,
+		Priority:      s.Priority,
+		Expiration:    s.Expiration,
+		Type:          s.Type,
+		MessageId:     s.MessageID,
+		CorrelationId: s.CorrelationID,
+		Timestamp:     time.Now(),
+		Body:          b,
+	}
+	if pub.MessageId == "" {
+		pub.MessageId = batchID
+	}
+	if s.Replies != nil {
+		if err := s.Replies.Prepare(&pub, item); err != nil {
+			return err
+		}
+	}
+	if s.Signer != nil {
+		sum := sha256.Sum256(b)
+		s.Signer.Sign(&pub, sum[:])
+	}
+	if err := pb.Publish("", spooledMessage{Exchange: s.Exchange, Key: s.Key, Mandatory: true, Publishing: pub}); err != nil {
+		return err
+	}
+	log.Printf("Sent the manifest of batch %s.", batchID)
+	return nil
+}
+
+// batchStore collects the pages of batches on disk, till the manifest and all the pages arrive.
+//
+// Every batch has its own directory under Dir, named by the batch ID.
+// The pages are stored as hidden .page-SEQ-HASH files, with their content hash,
+// and the manifest is in the hidden .manifest.json. When all the pages of the manifest
+// are there, they are renamed to their sequence number and file name, so they list in order.
+type batchStore struct {
+	Dir string
+	// Timeout is the time after an incomplete batch is dropped,
+	// counted from the arrival of the last message.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+const batchManifestName = ".manifest.json"
+
+// storedManifest is the manifest message, as stored in the batch's directory.
+type storedManifest struct {
+	Message  dumpedMessage `json:"message"`
+	Manifest batchManifest `json:"manifest"`
+}
+
+func newBatchStore(dir string, timeout time.Duration) *batchStore {
+	return &batchStore{Dir: dir, Timeout: timeout, running: make(map[string]bool)}
+}
+
+// Path returns the directory of the batch.
+func (bs *batchStore) Path(batchID string) (string, error) {
+	if batchID == "" || batchID != filepath.Base(batchID) || batchID[0] == '.' {
+		return "", &permanentError{Err: errgo.Newf("bad batch ID %q", batchID)}
+	}
+	dir := filepath.Join(bs.Dir, batchID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+	return dir, nil
+}
+
+// pageName returns the file name of the seq-th page of the batch, with the given name.
+func pageName(seq int64, name string) string { return fmt.Sprintf("%06d_%s", seq, name) }
+
+// stagedPageName returns the file name of the seq-th page of the batch, with the given content hash,
+// till the batch is complete.
+func stagedPageName(seq int64, contentHash string) string {
+	return fmt.Sprintf("%s%06d-%s", stagedPagePrefix, seq, contentHash)
+}
+
+const stagedPagePrefix = ".page-"
+
+// PutManifest stores the manifest message of the batch.
+func (bs *batchStore) PutManifest(batchID string, msg amqp.Delivery) error {
+	var m batchManifest
+	if err := json.Unmarshal(msg.Body, &m); err != nil {
+		return &permanentError{Err: errgo.Notef(err, "parse the manifest of batch %s", batchID)}
+	}
+	if m.BatchID != batchID {
+		return &permanentError{Err: errgo.Newf("manifest of batch %s is for %q", batchID, m.BatchID)}
+	}
+	for i, it := range m.Items {
+		if it.Seq != i {
+			return &permanentError{Err: errgo.Newf("manifest of batch %s: item %d has seq %d", batchID, i, it.Seq)}
+		}
+		if !isContentHash(it.ContentSha256) {
+			return &permanentError{Err: errgo.Newf("manifest of batch %s: item %d has bad content hash %q", batchID, i, it.ContentSha256)}
+		}
+	}
+	dir, err := bs.Path(batchID)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(storedManifest{Message: dumpedMessageOf(msg), Manifest: m})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, batchManifestName), b)
+}
+
+// Claim returns the manifest message of the batch, if it is complete and not claimed by someone else.
+// A batch is complete when every page of the manifest is there, with the content hash
+// in the manifest: then these pages are renamed to their final names, and the rest is removed.
+// A claimed batch has to be Released.
+func (bs *batchStore) Claim(batchID string) (amqp.Delivery, bool, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.running[batchID] {
+		return amqp.Delivery{}, false, nil
+	}
+	dir := filepath.Join(bs.Dir, batchID)
+	b, err := ioutil.ReadFile(filepath.Join(dir, batchManifestName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return amqp.Delivery{}, false, nil
+		}
+		return amqp.Delivery{}, false, err
+	}
+	var sm storedManifest
+	if err := json.Unmarshal(b, &sm); err != nil {
+		return amqp.Delivery{}, false, errgo.Notef(err, "parse %q", filepath.Join(dir, batchManifestName))
+	}
+	renames := make(map[string]string, len(sm.Manifest.Items))
+	for _, it := range sm.Manifest.Items {
+		name := sanitizeName(it.Name)
+		if name == "" || name[0] == '.' {
+			name = "page" + name
+		}
+		final := filepath.Join(dir, pageName(int64(it.Seq), name))
+		if _, err := os.Stat(final); err == nil {
+			continue // renamed by an earlier Claim
+		}
+		staged := filepath.Join(dir, stagedPageName(int64(it.Seq), it.ContentSha256))
+		if _, err := os.Stat(staged); err != nil {
+			if os.IsNotExist(err) {
+				return amqp.Delivery{}, false, nil
+			}
+			return amqp.Delivery{}, false, err
+		}
+		renames[staged] = final
+	}
+	for staged, final := range renames {
+		if err := os.Rename(staged, final); err != nil {
+			return amqp.Delivery{}, false, err
+		}
+	}
+	// the pages not in the manifest
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return amqp.Delivery{}, false, err
+	}
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), stagedPagePrefix) {
+			log.Printf("Batch %s: removing %q, which is not in the manifest.", batchID, fi.Name())
+			os.Remove(filepath.Join(dir, fi.Name()))
+		}
+	}
+	body, err := json.Marshal(sm.Manifest)
+	if err != nil {
+		return amqp.Delivery{}, false, err
+	}
+	pub, err := sm.Message.Publishing(body)
+	if err != nil {
+		return amqp.Delivery{}, false, err
+	}
+	bs.running[batchID] = true
+	log.Printf("Batch %s is complete (%d pages).", batchID, len(sm.Manifest.Items))
+	return amqp.Delivery{
+		Headers:         pub.Headers,
+		ContentType:     pub.ContentType,
+		ContentEncoding: pub.ContentEncoding,
+		DeliveryMode:    pub.DeliveryMode,
+		Priority:        pub.Priority,
+		CorrelationId:   pub.CorrelationId,
+		ReplyTo:         pub.ReplyTo,
+		Expiration:      pub.Expiration,
+		MessageId:       pub.MessageId,
+		Timestamp:       pub.Timestamp,
+		Type:            pub.Type,
+		UserId:          sm.Message.UserId,
+		AppId:           pub.AppId,
+		Exchange:        sm.Message.Exchange,
+		RoutingKey:      sm.Message.RoutingKey,
+		Redelivered:     sm.Message.Redelivered,
+		Body:            body,
+	}, true, nil
+}
+
+// Release the claim on the batch.
+func (bs *batchStore) Release(batchID string) {
+	bs.mu.Lock()
+	delete(bs.running, batchID)
+	bs.mu.Unlock()
+}
+
+// Done removes the batch's data.
+func (bs *batchStore) Done(batchID string) error {
+	return os.RemoveAll(filepath.Join(bs.Dir, batchID))
+}
+
+// Expire removes the batches which hasn't received any message for Timeout.
+func (bs *batchStore) Expire() error {
+	if bs.Timeout <= 0 {
+		return nil
+	}
+	fis, err := ioutil.ReadDir(bs.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	limit := time.Now().Add(-bs.Timeout)
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	for _, fi := range fis {
+		if !fi.IsDir() || !fi.ModTime().Before(limit) || bs.running[fi.Name()] {
+			continue
+		}
+		log.Printf("Batch %s is incomplete since %s, dropping it.", fi.Name(), fi.ModTime())
+		if err := bs.Done(fi.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleBatch stores the page or the manifest of the batch in the job,
+// and if that completes the batch, calls the handler with the batch's directory,
+// and the metadata of the manifest message.
+//
+// If the handler fails, the completing message goes to the Retrier,
+// and the batch is kept, so the retried message completes it again.
+func (cs consumer) handleBatch(j subJob, batchID string) error {
+	msg := j.Delivery
+	bs := cs.Batches
+	dir, err := bs.Path(batchID)
+	if err != nil {
+		return cs.fail(msg, j.TransferID, err)
+	}
+	if manifest, _ := msg.Headers[hdrBatchManifest].(bool); manifest {
+		if _, err = cs.Receiver.Verify(bytes.NewReader(msg.Body), msg); err == nil {
+			err = bs.PutManifest(batchID, msg)
+		}
+	} else {
+		err = cs.putPage(j, dir)
+	}
+	if err != nil {
+		return cs.fail(msg, j.TransferID, err)
+	}
+
+	m, ok, err := bs.Claim(batchID)
+	if err != nil {
+		return cs.fail(msg, j.TransferID, err)
+	}
+	if !ok {
+		cs.done(msg, j.TransferID)
+		return nil
+	}
+	defer bs.Release(batchID)
+	res, err := cs.Receiver.Run(dir, messageEnv(m), m)
+	if err != nil {
+		return cs.failReply(msg, m, j.TransferID, err)
+	}
+	cs.reply(m, res, nil)
+	if !cs.KeepFiles {
+		if err := bs.Done(batchID); err != nil {
+			log.Printf("Remove batch %s: %v", batchID, err)
+		}
+		if cs.Receiver.Sidecar {
+			os.Remove(dir + ".json")
+		}
+	}
+	cs.done(msg, j.TransferID)
+	return nil
+}
+
+// putPage writes the page in the job into the batch's directory (checking its signature
+// and content hash, see receiver.Write), unless it's there already.
+// The page is staged with its content hash, which the manifest has to agree with (see Claim).
+func (cs consumer) putPage(j subJob, dir string) error {
+	msg := j.Delivery
+	seq, ok := headerInt(msg.Headers[hdrBatchSeq])
+	count, _ := headerInt(msg.Headers[hdrBatchCount])
+	if !ok || seq < 0 || count > 0 && seq >= count {
+		return &permanentError{Err: errgo.Newf("bad page %v/%v", msg.Headers[hdrBatchSeq], msg.Headers[hdrBatchCount])}
+	}
+	contentHash := headerString(msg.Headers[hdrContentHash])
+	if !isContentHash(contentHash) {
+		return &permanentError{Err: errgo.Newf("page %d has bad %s header %q", seq, hdrContentHash, contentHash)}
+	}
+	fn := filepath.Join(dir, stagedPageName(seq, contentHash))
+	if _, err := os.Stat(fn); err == nil {
+		log.Printf("Page %d of %s is here already.", seq, filepath.Base(dir))
+		return nil
+	}
+	body, closeBody, err := openBody(j)
+	if err != nil {
+		return err
+	}
+	defer closeBody()
+	_, _, err = cs.Receiver.Write(fn, body, msg)
+	return err
+}
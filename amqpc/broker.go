@@ -0,0 +1,150 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+// Channel is the part of *amqp.Channel amqpc uses.
+type Channel interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueInspect(name string) (amqp.Queue, error)
+	QueuePurge(name string, noWait bool) (int, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// Broker is a connection to the broker: an *amqp.Connection (see amqpBroker),
+// or a connection to the in-memory memBroker of the tests.
+type Broker interface {
+	Channel() (Channel, error)
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// amqpBroker is a Broker over a real connection.
+type amqpBroker struct {
+	*amqp.Connection
+}
+
+func (b amqpBroker) Channel() (Channel, error) {
+	ch, err := b.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// amqpClient is a channel on a broker connection, with the declared queue.
+type amqpClient struct {
+	amqp.Queue
+	Channel
+	Broker
+}
+
+func (c *amqpClient) Close() error {
+	var err error
+	if c.Channel != nil {
+		err = c.Channel.Close()
+		c.Channel = nil
+	}
+	if c.Broker != nil {
+		if closeErr := c.Broker.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		c.Broker = nil
+	}
+	return err
+}
+
+// newClient connects to the server, and opens a client on it (see openClient).
+func newClient(server string, cfg amqp.Config, queue string, prefetch int) (*amqpClient, error) {
+	// Connections start with amqp.Dial() typically from a command line argument
+	// or environment variable.
+	conn, err := amqp.DialConfig(server, cfg)
+	if err != nil {
+		return nil, errgo.Notef(err, "url=%q", server)
+	}
+	return openClient(amqpBroker{conn}, queue, prefetch)
+}
+
+// openClient opens a channel on b with the given prefetch,
+// and declares the queue, if not empty. Closes b on error.
+func openClient(b Broker, queue string, prefetch int) (*amqpClient, error) {
+	c := &amqpClient{Broker: b}
+	var err error
+	// Most operations happen on a channel.  If any error is returned on a
+	// channel, the channel will no longer be valid, throw it away and try with
+	// a different channel.  If you use many channels, it's useful for the
+	// server to
+	if c.Channel, err = c.Broker.Channel(); err != nil {
+		c.Close()
+		return nil, errgo.Notef(err, "Channel")
+	}
+
+	// Declare your topology here, if it doesn't exist, it will be created, if
+	// it existed already and is not what you expect, then that's considered an
+	// error.
+	if err = c.Channel.Qos(prefetch, 0, false); err != nil {
+		c.Close()
+		return nil, errgo.Notef(err, "Qos")
+	}
+
+	// Use your connection on this topology with either Publish or Consume, or
+	// inspect your queues with QueueInspect.  It's unwise to mix Publish and
+	// Consume to let TCP do its job well.
+	if queue == "" {
+		return c, nil
+	}
+	// An existing queue is used as is, whatever arguments it has been declared with
+	// (see queue declare); a new one is declared without arguments.
+	if c.Queue, err = c.Channel.QueueDeclarePassive(queue, true, false, false, false, nil); err == nil {
+		return c, nil
+	}
+	if ae, ok := err.(*amqp.Error); !ok || ae.Code != amqp.NotFound {
+		c.Close()
+		return nil, errgo.Notef(err, "QueueDeclarePassive")
+	}
+	// the failed passive declaration closed the channel
+	if c.Channel, err = c.Broker.Channel(); err != nil {
+		c.Close()
+		return nil, errgo.Notef(err, "Channel")
+	}
+	if err = c.Channel.Qos(prefetch, 0, false); err != nil {
+		c.Close()
+		return nil, errgo.Notef(err, "Qos")
+	}
+	if c.Queue, err = c.Channel.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+		c.Close()
+		return nil, errgo.Notef(err, "QueueDeclare")
+	}
+
+	return c, nil
+}
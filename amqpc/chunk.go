@@ -0,0 +1,295 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+// Headers of a chunked transfer.
+// Every chunk carries all the headers of the original message, plus these.
+const (
+	hdrTransferID  = "TransferId"
+	hdrChunkIndex  = "ChunkIndex"
+	hdrChunkCount  = "ChunkCount"
+	hdrChunkSHA256 = "ChunkSHA256"
+)
+
+// DefaultChunkSize is the maximum body size of one message.
+// Bigger payloads are sent as a chunked transfer.
+const DefaultChunkSize = 16 << 20
+
+// publishChunked publishes the content of fh as size/chunkSize messages to the exchange,
+// each with a copy of pub's headers and properties.
+// The messages are mandatory, so the unroutable ones are returned.
+//
+// Returns the number of messages published.
+func publishChunked(p *publisher, exchange, key string, pub amqp.Publishing, fh *os.File, chunkSize int) (int, error) {
+	fi, err := fh.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	count := int((size + int64(chunkSize) - 1) / int64(chunkSize))
+	transferID, err := newID()
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Sending %d bytes as transfer %s in %d chunks.", size, transferID, count)
+
+	for i := 0; i < count; i++ {
+		// the publisher may hold the message till confirmation, so don't reuse the buffer
+		b := make([]byte, chunkSize)
+		n, err := io.ReadFull(fh, b)
+		if err != nil && !(err == io.ErrUnexpectedEOF && i == count-1) {
+			return i, errgo.Notef(err, "read chunk %d of %q", i, fh.Name())
+		}
+		sum := sha256.Sum256(b[:n])
+		msg := pub
+		msg.Headers = make(amqp.Table, len(pub.Headers)+4)
+		for k, v := range pub.Headers {
+			msg.Headers[k] = v
+		}
+		msg.Headers[hdrTransferID] = transferID
+		msg.Headers[hdrChunkIndex] = int32(i)
+		msg.Headers[hdrChunkCount] = int32(count)
+		msg.Headers[hdrChunkSHA256] = hex.EncodeToString(sum[:])
+		msg.Body = b[:n]
+		if err := p.Publish("", spooledMessage{Exchange: exchange, Key: key, Mandatory: true, Publishing: msg}); err != nil {
+			return i, errgo.Notef(err, "Publish chunk %d", i)
+		}
+	}
+	return count, nil
+}
+
+// spoolToTemp writes head and the rest of r into a temp file,
+// and returns it rewound.
+func spoolToTemp(head []byte, r io.Reader) (*os.File, error) {
+	fh, err := ioutil.TempFile("", "amqpc-pub-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fh.Write(head); err == nil {
+		if _, err = io.Copy(fh, r); err == nil {
+			_, err = fh.Seek(0, 0)
+		}
+	}
+	if err != nil {
+		fh.Close()
+		os.Remove(fh.Name())
+		return nil, errgo.Notef(err, "spool to %q", fh.Name())
+	}
+	return fh, nil
+}
+
+// newID returns a new random ID, as 32 hex digits.
+func newID() (string, error) {
+	var a [16]byte
+	if _, err := io.ReadFull(rand.Reader, a[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(a[:]), nil
+}
+
+// chunkStore collects the chunks of transfers on disk, till all arrive.
+//
+// Every transfer has its own directory under Dir, named by the transfer ID.
+type chunkStore struct {
+	Dir string
+	// Timeout is the time after an incomplete transfer is dropped,
+	// counted from the arrival of the last chunk.
+	Timeout time.Duration
+}
+
+// Put stores the chunk in msg.
+// If this completes the transfer, the returned path points to the reassembled data.
+func (cs chunkStore) Put(transferID string, msg amqp.Delivery) (string, error) {
+	if transferID == "" || transferID != filepath.Base(transferID) || transferID[0] == '.' {
+		return "", errgo.Newf("bad transfer ID %q", transferID)
+	}
+	index, ok := headerInt(msg.Headers[hdrChunkIndex])
+	if !ok {
+		return "", errgo.Newf("transfer %s: bad %s header %v", transferID, hdrChunkIndex, msg.Headers[hdrChunkIndex])
+	}
+	count, ok := headerInt(msg.Headers[hdrChunkCount])
+	if !ok || count <= 0 || index < 0 || index >= count {
+		return "", errgo.Newf("transfer %s: bad chunk %v/%v", transferID, msg.Headers[hdrChunkIndex], msg.Headers[hdrChunkCount])
+	}
+	sum := sha256.Sum256(msg.Body)
+	if want, _ := msg.Headers[hdrChunkSHA256].(string); want != hex.EncodeToString(sum[:]) {
+		return "", errgo.Newf("transfer %s: chunk %d checksum mismatch (got %x, wanted %s)", transferID, index, sum, want)
+	}
+
+	dir := filepath.Join(cs.Dir, transferID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, chunkName(index)), msg.Body); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+
+	for i := int64(0); i < count; i++ {
+		if _, err := os.Stat(filepath.Join(dir, chunkName(i))); err != nil {
+			if os.IsNotExist(err) {
+				return "", nil
+			}
+			return "", err
+		}
+	}
+
+	fn := filepath.Join(dir, "data")
+	fh, err := os.Create(fn)
+	if err != nil {
+		return "", err
+	}
+	for i := int64(0); i < count; i++ {
+		ch, err := os.Open(filepath.Join(dir, chunkName(i)))
+		if err != nil {
+			fh.Close()
+			return "", err
+		}
+		_, err = io.Copy(fh, ch)
+		ch.Close()
+		if err != nil {
+			fh.Close()
+			return "", errgo.Notef(err, "reassemble %q", fn)
+		}
+	}
+	if err := fh.Close(); err != nil {
+		return "", err
+	}
+	log.Printf("Transfer %s is complete (%d chunks).", transferID, count)
+	return fn, nil
+}
+
+// Republish calls publish with each stored chunk of the transfer,
+// with the headers and properties of pub.
+func (cs chunkStore) Republish(transferID string, pub amqp.Publishing, publish func(amqp.Publishing) error) error {
+	count, ok := headerInt(pub.Headers[hdrChunkCount])
+	if !ok {
+		return errgo.Newf("transfer %s: bad %s header %v", transferID, hdrChunkCount, pub.Headers[hdrChunkCount])
+	}
+	dir := filepath.Join(cs.Dir, transferID)
+	for i := int64(0); i < count; i++ {
+		b, err := ioutil.ReadFile(filepath.Join(dir, chunkName(i)))
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b)
+		msg := pub
+		msg.Headers = make(amqp.Table, len(pub.Headers))
+		for k, v := range pub.Headers {
+			msg.Headers[k] = v
+		}
+		msg.Headers[hdrChunkIndex] = int32(i)
+		msg.Headers[hdrChunkSHA256] = hex.EncodeToString(sum[:])
+		msg.Body = b
+		if err := publish(msg); err != nil {
+			return errgo.Notef(err, "republish chunk %d of %s", i, transferID)
+		}
+	}
+	return nil
+}
+
+// Done removes the transfer's data.
+func (cs chunkStore) Done(transferID string) error {
+	return os.RemoveAll(filepath.Join(cs.Dir, transferID))
+}
+
+// Expire removes the transfers which hasn't received any chunk for Timeout.
+func (cs chunkStore) Expire() error {
+	if cs.Timeout <= 0 {
+		return nil
+	}
+	fis, err := ioutil.ReadDir(cs.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	limit := time.Now().Add(-cs.Timeout)
+	for _, fi := range fis {
+		if !fi.IsDir() || !fi.ModTime().Before(limit) {
+			continue
+		}
+		log.Printf("Transfer %s is incomplete since %s, dropping it.", fi.Name(), fi.ModTime())
+		if err := os.RemoveAll(filepath.Join(cs.Dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func chunkName(index int64) string { return fmt.Sprintf("%06d.chunk", index) }
+
+// writeFileAtomic writes data to a temp file and renames it to fn.
+func writeFileAtomic(fn string, data []byte) error {
+	fh, err := ioutil.TempFile(filepath.Dir(fn), "."+filepath.Base(fn)+"-")
+	if err != nil {
+		return err
+	}
+	_, err = fh.Write(data)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(fh.Name(), fn)
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+	}
+	return err
+}
+
+// headerInt returns the integer value of an amqp.Table field.
+func headerInt(v interface{}) (int64, bool) {
+	switch x := v.(type) {
+	case byte:
+		return int64(x), true
+	case int16:
+		return int64(x), true
+	case int32:
+		return int64(x), true
+	case int64:
+		return x, true
+	case int:
+		return int64(x), true
+	case string:
+		i, err := strconv.ParseInt(x, 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
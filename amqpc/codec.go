@@ -0,0 +1,168 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// codec is a content-coding, named by its Content-Encoding token.
+type codec struct {
+	Name      string
+	NewWriter func(io.Writer) (io.WriteCloser, error)
+	NewReader func(io.Reader) (io.ReadCloser, error)
+}
+
+// Compress modes besides the codec names.
+const (
+	compressAuto = "auto"
+	compressNone = "none"
+)
+
+// autoCodec is the codec used by the "auto" compress mode.
+const autoCodec = "gzip"
+
+var codecs = map[string]codec{
+	"gzip": {
+		Name:      "gzip",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+	"zstd": {
+		Name:      "zstd",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	},
+	"xz": {
+		Name:      "xz",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			xr, err := xz.NewReader(r)
+			return ioutil.NopCloser(xr), err
+		},
+	},
+}
+
+// codecAliases maps the Content-Encoding values used by older senders
+// (and the common variants) to codec names.
+var codecAliases = map[string]string{
+	"application/gzip": "gzip",
+	"x-gzip":           "gzip",
+	"application/zstd": "zstd",
+	"application/x-xz": "xz",
+}
+
+// compressedTypes are the MIME types not worth compressing again in auto mode.
+var compressedTypes = map[string]bool{
+	"application/zip":              true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/x-xz":             true,
+	"application/zstd":             true,
+	"application/x-bzip2":          true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/pdf":              true,
+	"image/png":                    true,
+	"image/jpeg":                   true,
+	"image/gif":                    true,
+	"image/webp":                   true,
+}
+
+// codecNames returns the names accepted by --compress.
+func codecNames() string {
+	names := make([]string, 0, len(codecs)+2)
+	for k := range codecs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(append(names, compressAuto, compressNone), ", ")
+}
+
+// chooseCodec returns the codec for the compress mode and the content's MIME type,
+// or an empty name for no compression.
+func chooseCodec(mode, mimeType string) (codec, error) {
+	switch mode {
+	case compressNone, "":
+		return codec{}, nil
+	case compressAuto:
+		if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+			mimeType = mimeType[:i]
+		}
+		mimeType = strings.TrimSpace(mimeType)
+		if compressedTypes[mimeType] || strings.HasPrefix(mimeType, "video/") || strings.HasPrefix(mimeType, "audio/") {
+			return codec{}, nil
+		}
+		mode = autoCodec
+	}
+	c, ok := codecs[mode]
+	if !ok {
+		return c, errgo.Newf("unknown compression %q (%s)", mode, codecNames())
+	}
+	return c, nil
+}
+
+// compressReader returns a reader of the content of r, encoded with c.
+// Closing it closes r.
+func compressReader(r io.ReadCloser, c codec) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer r.Close()
+		w, err := c.NewWriter(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+	return pr
+}
+
+// decodeReader returns a reader of the decoded content of r,
+// according to the Content-Encoding.
+func decodeReader(contentEncoding string, r io.Reader) (io.ReadCloser, error) {
+	name := strings.ToLower(strings.TrimSpace(contentEncoding))
+	if name == "" || name == "identity" {
+		return ioutil.NopCloser(r), nil
+	}
+	if alias, ok := codecAliases[name]; ok {
+		name = alias
+	}
+	c, ok := codecs[name]
+	if !ok {
+		return nil, errgo.Newf("unknown Content-Encoding %q", contentEncoding)
+	}
+	return c.NewReader(r)
+}
@@ -0,0 +1,214 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+// subJob is a message to be handled by a worker of sub.
+type subJob struct {
+	amqp.Delivery
+	Seq uint64
+	// TransferID is the ID of the chunked transfer this message completed,
+	// and DataFn is the path of the reassembled data.
+	TransferID, DataFn string
+}
+
+// consumer processes the deliveries of sub: it collects the chunks of the big
+// transfers, calls the Receiver with the complete messages, replies to them,
+// and retries or dead-letters the failed ones through the Retrier.
+type consumer struct {
+	Receiver receiver
+	Retrier  *retrier
+	Chunks   chunkStore
+	// OutputDir is where the files are written, named by NameTemplate,
+	// and kept if the handler succeeds (a retry writes them again).
+	// If empty, they are written into the worker's directory,
+	// and removed after handling, unless KeepFiles is set.
+	OutputDir    string
+	NameTemplate *template.Template
+	KeepFiles    bool
+	// Processed, if not nil, has the content hashes of the processed messages:
+	// the duplicates are ACKed without calling the handler.
+	Processed *processedStore
+	// Batches, if not nil, collects the pages of the batches,
+	// and the Receiver gets the directory of the complete ones.
+	Batches *batchStore
+}
+
+// Prepare returns the job for msg, the seq-th message received.
+// ok is false if there's nothing to do: msg is a chunk of an incomplete
+// transfer (and ACKed), or it couldn't be stored (and is retried).
+//
+// Returns error only if msg could be neither stored, nor retried (and it is NACKed for redelivery).
+func (cs consumer) Prepare(msg amqp.Delivery, seq uint64) (j subJob, ok bool, err error) {
+	j = subJob{Delivery: msg, Seq: seq}
+	if j.TransferID, _ = msg.Headers[hdrTransferID].(string); j.TransferID == "" {
+		return j, true, nil
+	}
+	if j.DataFn, err = cs.Chunks.Put(j.TransferID, msg); err != nil {
+		return j, false, cs.fail(msg, "", err)
+	}
+	if j.DataFn == "" {
+		if err := msg.Ack(false); err != nil {
+			log.Printf("cannot ACK %q: %v", msg.MessageId, err)
+		}
+		return j, false, nil
+	}
+	return j, true, nil
+}
+
+// Handle receives the message of the job into dir (or OutputDir),
+// replies to it if asked, then ACKs it, or hands it to the Retrier if failed.
+// Only the final outcome is replied to: the success, or the dead-lettering.
+// A page or manifest of a batch goes to the Batches, if set (see handleBatch).
+//
+// Returns error only if the failed message could be neither retried, nor dead-lettered.
+func (cs consumer) Handle(j subJob, dir string) error {
+	msg := j.Delivery
+	if cs.Batches != nil {
+		// the pages are not checked for duplicates, as all of them are needed
+		if batchID := headerString(msg.Headers[hdrBatchID]); batchID != "" {
+			return cs.handleBatch(j, batchID)
+		}
+	}
+	if err := cs.handle(j, dir); err != nil {
+		return cs.fail(msg, j.TransferID, err)
+	}
+	cs.done(msg, j.TransferID)
+	return nil
+}
+
+// handle the message of the job: write it (checking its signature and content hash),
+// and if its content hash is not found in Processed, call the handler with it.
+// Replies if asked and succeeded (the failures are replied to by fail, when dead-lettered).
+func (cs consumer) handle(j subJob, dir string) error {
+	msg := j.Delivery
+	body, closeBody, err := openBody(j)
+	if err != nil {
+		return err
+	}
+	defer closeBody()
+
+	on := outputNameOf(msg, j.Seq)
+	fn := filepath.Join(dir, on.FileName)
+	if cs.OutputDir != "" {
+		if fn, err = outputPath(cs.OutputDir, cs.NameTemplate, on); err != nil {
+			return err
+		}
+	}
+
+	fn, env, err := cs.Receiver.Write(fn, body, msg)
+	if err != nil {
+		return err
+	}
+	// Write has checked the content hash, so a false one can't skip a message.
+	var contentHash string
+	if cs.Processed != nil {
+		contentHash = headerString(msg.Headers[hdrContentHash])
+	}
+	if contentHash != "" && !cs.Processed.Begin(contentHash) {
+		log.Printf("Skipping %q: its content (%s) has been processed already.", msg.MessageId, contentHash)
+		os.Remove(fn)
+		os.Remove(fn + ".json")
+		cs.reply(msg, &handlerResult{Duplicate: true}, nil)
+		return nil
+	}
+
+	res, err := cs.Receiver.Run(fn, env, msg)
+	if contentHash != "" {
+		if doneErr := cs.Processed.Done(contentHash, err == nil); doneErr != nil {
+			log.Printf("Record %s as processed: %v", contentHash, doneErr)
+		}
+	}
+	if cs.OutputDir == "" && !cs.KeepFiles || cs.OutputDir != "" && err != nil {
+		os.Remove(fn)
+		os.Remove(fn + ".json")
+	}
+	if err == nil {
+		cs.reply(msg, res, nil)
+	}
+	return err
+}
+
+// openBody returns the body of the job's message: the reassembled data of a transfer,
+// or the message's body.
+func openBody(j subJob) (io.ReadSeeker, func() error, error) {
+	if j.DataFn == "" {
+		return bytes.NewReader(j.Body), func() error { return nil }, nil
+	}
+	fh, err := os.Open(j.DataFn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fh, fh.Close, nil
+}
+
+// done finishes the transfer (if any), and ACKs msg.
+func (cs consumer) done(msg amqp.Delivery, transferID string) {
+	if transferID != "" {
+		if err := cs.Chunks.Done(transferID); err != nil {
+			log.Printf("Remove transfer %s: %v", transferID, err)
+		}
+	}
+	if err := msg.Ack(false); err != nil {
+		log.Printf("cannot ACK %q: %v", msg.MessageId, err)
+	}
+}
+
+// fail hands msg to the Retrier. If that fails, msg is NACKed for redelivery,
+// and the error is returned.
+func (cs consumer) fail(msg amqp.Delivery, transferID string, cause error) error {
+	return cs.failReply(msg, msg, transferID, cause)
+}
+
+// failReply is fail, but replies to replyMsg (if asked) when msg is dead-lettered:
+// the retries are not replied to, only the final outcome.
+func (cs consumer) failReply(msg, replyMsg amqp.Delivery, transferID string, cause error) error {
+	deadLettered, err := cs.Retrier.Fail(msg, transferID, cause)
+	if err != nil {
+		msg.Nack(false, true)
+		return err
+	}
+	if deadLettered {
+		var res *handlerResult
+		if he, ok := errgo.Cause(cause).(*handlerError); ok {
+			res = he.handlerResult
+		}
+		cs.reply(replyMsg, res, cause)
+	}
+	return nil
+}
+
+// reply sends the outcome to msg.ReplyTo, if asked.
+func (cs consumer) reply(msg amqp.Delivery, res *handlerResult, err error) {
+	if msg.ReplyTo == "" {
+		return
+	}
+	if err := cs.Retrier.Reply(msg, res, err); err != nil {
+		log.Printf("Reply to %q: %v", msg.ReplyTo, err)
+	}
+}
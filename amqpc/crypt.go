@@ -0,0 +1,295 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Headers of an encrypted message.
+const (
+	hdrEncryption = "Encryption"
+	hdrKeyID      = "KeyId"
+)
+
+// encryptionScheme is the value of the Encryption header.
+//
+// The encrypted body starts with the sender's ephemeral X25519 public key,
+// followed by the payload in segments of cryptSegmentSize, each sealed
+// with ChaCha20-Poly1305. The key is derived with HKDF-SHA256 from the shared
+// secret, and the nonce is the segment's counter plus a flag marking the last
+// segment, so reordering and truncation are detected, too.
+const encryptionScheme = "X25519-ChaCha20-Poly1305"
+
+const cryptSegmentSize = 64 << 10
+
+// cryptKey is an X25519 public or private key, or an Ed25519 public key or seed.
+type cryptKey [curve25519.ScalarSize]byte
+
+// keyring maps the key IDs to the private keys.
+type keyring map[string]*cryptKey
+
+// keyID returns the ID of the public key: the first 8 bytes of its SHA-256 hash, in hex.
+func keyID(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+func publicKeyOf(priv *cryptKey) (*cryptKey, error) {
+	b, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	var pub cryptKey
+	copy(pub[:], b)
+	return &pub, nil
+}
+
+// generateKey returns a new random private key, and its public key.
+func generateKey() (priv, pub *cryptKey, err error) {
+	priv = new(cryptKey)
+	if _, err = io.ReadFull(rand.Reader, priv[:]); err != nil {
+		return nil, nil, err
+	}
+	if pub, err = publicKeyOf(priv); err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+// writeKeyFile writes the key base64-encoded into the new file fn, after a comment line.
+func writeKeyFile(fn string, key []byte, comment string, perm os.FileMode) error {
+	fh, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(fh, "# "+comment+"\n"+base64.StdEncoding.EncodeToString(key)+"\n")
+	if closeErr := fh.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readKeyFile reads a key written by writeKeyFile; lines starting with # are ignored.
+func readKeyFile(fn string) (*cryptKey, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, errgo.Notef(err, "parse %q", fn)
+		}
+		var key cryptKey
+		if len(k) != len(key) {
+			return nil, errgo.Newf("%q: key length is %d, wanted %d", fn, len(k), len(key))
+		}
+		copy(key[:], k)
+		return &key, nil
+	}
+	return nil, errgo.Newf("%q: no key found", fn)
+}
+
+// readIdentities reads the private key files into a keyring.
+func readIdentities(files []string) (keyring, error) {
+	ids := make(keyring, len(files))
+	for _, fn := range files {
+		priv, err := readKeyFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		pub, err := publicKeyOf(priv)
+		if err != nil {
+			return nil, errgo.Notef(err, "%q", fn)
+		}
+		ids[keyID(pub[:])] = priv
+	}
+	return ids, nil
+}
+
+// segmentAEAD returns the AEAD for the segments, keyed from the shared secret of priv and peer.
+func segmentAEAD(priv, peer, ephemeral, recipient *cryptKey) (cipher.AEAD, error) {
+	shared, err := curve25519.X25519(priv[:], peer[:])
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 0, len(ephemeral)+len(recipient))
+	salt = append(append(salt, ephemeral[:]...), recipient[:]...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte("amqpc "+encryptionScheme)), key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+func segmentNonce(nonce *[chacha20poly1305.NonceSize]byte, counter uint64, last bool) {
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], counter)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+}
+
+// encryptReader returns a reader of the content of r, encrypted to recipient.
+// Closing it closes r.
+func encryptReader(r io.ReadCloser, recipient *cryptKey) (io.ReadCloser, error) {
+	priv, ephemeral, err := generateKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := segmentAEAD(priv, recipient, ephemeral, recipient)
+	if err != nil {
+		return nil, errgo.Notef(err, "bad recipient key")
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer r.Close()
+		if _, err := pw.Write(ephemeral[:]); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(sealSegments(pw, r, aead))
+	}()
+	return pr, nil
+}
+
+func sealSegments(w io.Writer, r io.Reader, aead cipher.AEAD) error {
+	br := bufio.NewReaderSize(r, cryptSegmentSize)
+	buf := make([]byte, cryptSegmentSize, cryptSegmentSize+aead.Overhead())
+	var nonce [chacha20poly1305.NonceSize]byte
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(br, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		if !last {
+			if _, err := br.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+		segmentNonce(&nonce, counter, last)
+		if _, err := w.Write(aead.Seal(buf[:0], nonce[:], buf[:n], nil)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// decryptReader returns a reader of the plaintext of the encrypted body r,
+// decrypted with the identity of keyID.
+//
+// Undecryptable content is reported as *permanentError, by decryptReader
+// and by the returned reader, too.
+func decryptReader(r io.Reader, ids keyring, keyID string) (io.Reader, error) {
+	priv := ids[keyID]
+	if priv == nil {
+		return nil, &permanentError{Err: errgo.Newf("no identity for key %q", keyID)}
+	}
+	pub, err := publicKeyOf(priv)
+	if err != nil {
+		return nil, err
+	}
+	var ephemeral cryptKey
+	if _, err := io.ReadFull(r, ephemeral[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, &permanentError{Err: errgo.New("encrypted body is too short")}
+		}
+		return nil, err
+	}
+	aead, err := segmentAEAD(priv, &ephemeral, &ephemeral, pub)
+	if err != nil {
+		return nil, &permanentError{Err: errgo.Notef(err, "bad ephemeral key")}
+	}
+	return &openReader{r: bufio.NewReaderSize(r, cryptSegmentSize+aead.Overhead()), aead: aead}, nil
+}
+
+// openReader decrypts the segments written by sealSegments.
+type openReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	counter uint64
+	buf     []byte
+	plain   []byte
+	last    bool
+	err     error
+}
+
+func (or *openReader) Read(p []byte) (int, error) {
+	for len(or.plain) == 0 {
+		if or.err != nil {
+			return 0, or.err
+		}
+		if or.last {
+			return 0, io.EOF
+		}
+		or.err = or.next()
+	}
+	n := copy(p, or.plain)
+	or.plain = or.plain[n:]
+	return n, nil
+}
+
+func (or *openReader) next() error {
+	if or.buf == nil {
+		or.buf = make([]byte, cryptSegmentSize+or.aead.Overhead())
+	}
+	n, err := io.ReadFull(or.r, or.buf)
+	last := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		return err
+	}
+	if !last {
+		if _, err := or.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	segmentNonce(&nonce, or.counter, last)
+	plain, err := or.aead.Open(or.buf[:0], nonce[:], or.buf[:n], nil)
+	if err != nil {
+		return &permanentError{Err: errgo.Newf("segment %d cannot be decrypted", or.counter)}
+	}
+	or.counter++
+	or.plain, or.last = plain, last
+	return nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// hdrContentHash is the header of the SHA-256 of the message's content
+// (before compression and encryption), in hex.
+const hdrContentHash = "ContentSha256"
+
+// isContentHash reports whether s looks like a content hash: 64 hex digits.
+func isContentHash(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// processedStore remembers the content hashes of the processed messages
+// for Retention, so the duplicates can be skipped.
+//
+// The hashes are kept in a flat file of "time hash" lines, appended after
+// each processed message; the expired lines are dropped on opening.
+// It is safe for concurrent use.
+type processedStore struct {
+	Retention time.Duration
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	fh   *os.File
+	seen map[string]time.Time
+	// inFlight are the hashes being processed.
+	inFlight map[string]bool
+}
+
+// openProcessedStore reads the hashes processed within retention from fn,
+// and rewrites it without the expired ones.
+func openProcessedStore(fn string, retention time.Duration) (*processedStore, error) {
+	ps := &processedStore{Retention: retention, seen: make(map[string]time.Time), inFlight: make(map[string]bool)}
+	ps.cond = sync.NewCond(&ps.mu)
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return nil, err
+	}
+	fh, err := os.Open(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		limit := time.Now().Add(-retention)
+		scanner := bufio.NewScanner(fh)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 2 {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, fields[0])
+			if err != nil || t.Before(limit) {
+				continue
+			}
+			if t.After(ps.seen[fields[1]]) {
+				ps.seen[fields[1]] = t
+			}
+		}
+		err = scanner.Err()
+		fh.Close()
+		if err != nil {
+			return nil, errgo.Notef(err, "read %q", fn)
+		}
+	}
+
+	// compact
+	sums := make([]string, 0, len(ps.seen))
+	for sum := range ps.seen {
+		sums = append(sums, sum)
+	}
+	sort.Slice(sums, func(i, j int) bool { return ps.seen[sums[i]].Before(ps.seen[sums[j]]) })
+	var buf bytes.Buffer
+	for _, sum := range sums {
+		fmt.Fprintf(&buf, "%s %s\n", ps.seen[sum].Format(time.RFC3339), sum)
+	}
+	if err := writeFileAtomic(fn, buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if ps.fh, err = os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// Begin reports whether the content with the hash sum should be processed:
+// false if it has been processed within Retention. If the same content
+// is being processed at the moment, Begin waits for its Done.
+//
+// If Begin returns true, Done must be called.
+func (ps *processedStore) Begin(sum string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for ps.inFlight[sum] {
+		ps.cond.Wait()
+	}
+	if t, ok := ps.seen[sum]; ok && time.Since(t) < ps.Retention {
+		return false
+	}
+	ps.inFlight[sum] = true
+	return true
+}
+
+// Done ends the processing of the content begun with Begin,
+// and records it if processed is true.
+func (ps *processedStore) Done(sum string, processed bool) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(ps.inFlight, sum)
+	ps.cond.Broadcast()
+	if !processed {
+		return nil
+	}
+	now := time.Now()
+	ps.seen[sum] = now
+	if _, err := fmt.Fprintf(ps.fh, "%s %s\n", now.Format(time.RFC3339), sum); err != nil {
+		return err
+	}
+	return ps.fh.Sync()
+}
+
+// Close the store's file.
+func (ps *processedStore) Close() error { return ps.fh.Close() }
@@ -0,0 +1,284 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+// Extensions of the files of a message in a dump archive: NNNNNN.json and NNNNNN.body.
+const (
+	dumpPropsExt = ".json"
+	dumpBodyExt  = ".body"
+)
+
+// dumpedMessage is the properties file of a message in a dump archive.
+type dumpedMessage struct {
+	messageMeta
+	DeliveryMode uint8  `json:"deliveryMode,omitempty"`
+	Expiration   string `json:"expiration,omitempty"`
+	// HeaderTypes are the types of the headers which JSON can't tell:
+	// byte, int16, int32, int64, float32, float64, bytes, timestamp or decimal.
+	// The tables and arrays are restored with int64 and float64 numbers.
+	HeaderTypes map[string]string `json:"headerTypes,omitempty"`
+}
+
+func dumpedMessageOf(d amqp.Delivery) dumpedMessage {
+	dm := dumpedMessage{messageMeta: metaOf(d), DeliveryMode: d.DeliveryMode, Expiration: d.Expiration}
+	for k, v := range d.Headers {
+		var typ string
+		switch v.(type) {
+		case byte:
+			typ = "byte"
+		case int16:
+			typ = "int16"
+		case int32:
+			typ = "int32"
+		case int64:
+			typ = "int64"
+		case float32:
+			typ = "float32"
+		case float64:
+			typ = "float64"
+		case []byte:
+			typ = "bytes"
+		case time.Time:
+			typ = "timestamp"
+		case amqp.Decimal:
+			typ = "decimal"
+		default:
+			continue
+		}
+		if dm.HeaderTypes == nil {
+			dm.HeaderTypes = make(map[string]string)
+		}
+		dm.HeaderTypes[k] = typ
+	}
+	return dm
+}
+
+// Publishing returns the message with the properties and the body.
+// The user ID is left out, as the broker accepts only the connecting user's.
+func (dm dumpedMessage) Publishing(body []byte) (amqp.Publishing, error) {
+	headers := jsonTable(amqp.Table(dm.Headers))
+	for k, typ := range dm.HeaderTypes {
+		v, err := retypeHeader(headers[k], typ)
+		if err != nil {
+			return amqp.Publishing{}, errgo.Notef(err, "header %q", k)
+		}
+		headers[k] = v
+	}
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     dm.ContentType,
+		ContentEncoding: dm.ContentEncoding,
+		DeliveryMode:    dm.DeliveryMode,
+		Priority:        dm.Priority,
+		CorrelationId:   dm.CorrelationId,
+		ReplyTo:         dm.ReplyTo,
+		Expiration:      dm.Expiration,
+		MessageId:       dm.MessageId,
+		Timestamp:       dm.Timestamp,
+		Type:            dm.Type,
+		AppId:           dm.AppId,
+		Body:            body,
+	}, nil
+}
+
+// retypeHeader converts the JSON-decoded header value back to typ (see dumpedMessage).
+func retypeHeader(v interface{}, typ string) (interface{}, error) {
+	var n float64
+	switch x := v.(type) {
+	case int64:
+		n = float64(x)
+	case float64:
+		n = x
+	}
+	s, _ := v.(string)
+	switch typ {
+	case "byte":
+		return byte(n), nil
+	case "int16":
+		return int16(n), nil
+	case "int32":
+		return int32(n), nil
+	case "int64":
+		if i, ok := v.(int64); ok {
+			return i, nil
+		}
+		return int64(n), nil
+	case "float32":
+		return float32(n), nil
+	case "float64":
+		return n, nil
+	case "bytes":
+		return base64.StdEncoding.DecodeString(s)
+	case "timestamp":
+		return time.Parse(time.RFC3339Nano, s)
+	case "decimal":
+		// jsonTable has made it a table already
+		m, _ := v.(amqp.Table)
+		scale, _ := headerInt(m["Scale"])
+		value, _ := headerInt(m["Value"])
+		return amqp.Decimal{Scale: uint8(scale), Value: int32(value)}, nil
+	}
+	return nil, errgo.Newf("unknown type %q", typ)
+}
+
+// dumpQueue gets at most max (0 means all) messages from the queue,
+// and writes them into a tar archive to w, each as NNNNNN.json (the properties)
+// and NNNNNN.body.
+//
+// The messages are left unacknowledged: the caller must ACK (drain) or NACK (requeue)
+// them with the returned last delivery (with multiple=true), after the archive is safe.
+// Returns the number of messages written.
+func dumpQueue(ch Channel, queue string, max int, w io.Writer) (int, amqp.Delivery, error) {
+	tw := tar.NewWriter(w)
+	var last amqp.Delivery
+	var n int
+	for max <= 0 || n < max {
+		msg, ok, err := ch.Get(queue, false)
+		if err != nil {
+			return n, last, errgo.Notef(err, "Get(%q)", queue)
+		}
+		if !ok {
+			break
+		}
+		last = msg
+		n++
+		props, err := json.MarshalIndent(dumpedMessageOf(msg), "", "  ")
+		if err != nil {
+			return n, last, errgo.Notef(err, "encode the properties of %q", msg.MessageId)
+		}
+		mtime := msg.Timestamp
+		if mtime.IsZero() {
+			mtime = time.Now()
+		}
+		name := fmt.Sprintf("%06d", n)
+		for _, f := range []struct {
+			name string
+			data []byte
+		}{{name + dumpPropsExt, append(props, '\n')}, {name + dumpBodyExt, msg.Body}} {
+			if err := tw.WriteHeader(&tar.Header{
+				Name: f.name, Mode: 0644, Size: int64(len(f.data)), ModTime: mtime,
+				Typeflag: tar.TypeReg,
+			}); err != nil {
+				return n, last, err
+			}
+			if _, err := tw.Write(f.data); err != nil {
+				return n, last, err
+			}
+		}
+	}
+	return n, last, tw.Close()
+}
+
+// loadArchive publishes the messages of the dump archive read from r through pb,
+// in the order of the archive. If queue is not empty, the messages go to it
+// (through the default exchange), else to their original exchange with their routing key.
+//
+// Returns the number of messages published (not necessarily confirmed yet).
+func loadArchive(r io.Reader, pb *publisher, queue string) (int, error) {
+	type parts struct {
+		props    *dumpedMessage
+		body     []byte
+		haveBody bool
+	}
+	pending := make(map[string]*parts)
+	var n int
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, errgo.Notef(err, "read archive")
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		ext := path.Ext(hdr.Name)
+		if ext != dumpPropsExt && ext != dumpBodyExt {
+			log.Printf("Skipping %q.", hdr.Name)
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return n, errgo.Notef(err, "read %q", hdr.Name)
+		}
+		name := strings.TrimSuffix(hdr.Name, ext)
+		p := pending[name]
+		if p == nil {
+			p = new(parts)
+			pending[name] = p
+		}
+		if ext == dumpBodyExt {
+			p.body, p.haveBody = b, true
+		} else {
+			p.props = new(dumpedMessage)
+			// keep the numbers as they are, a float64 would round the big int64s
+			dec := json.NewDecoder(bytes.NewReader(b))
+			dec.UseNumber()
+			if err := dec.Decode(p.props); err != nil {
+				return n, errgo.Notef(err, "parse %q", hdr.Name)
+			}
+		}
+		if p.props == nil || !p.haveBody {
+			continue
+		}
+		delete(pending, name)
+
+		pub, err := p.props.Publishing(p.body)
+		if err != nil {
+			return n, errgo.Notef(err, "%q", name)
+		}
+		// mandatory, so the unroutable messages are returned, not lost silently
+		msg := spooledMessage{Exchange: p.props.Exchange, Key: p.props.RoutingKey, Mandatory: true, Publishing: pub}
+		if queue != "" {
+			msg.Exchange, msg.Key = "", queue
+		}
+		if err := pb.Publish("", msg); err != nil {
+			return n, err
+		}
+		if err := pb.Offline(); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if len(pending) != 0 {
+		names := make([]string, 0, len(pending))
+		for name := range pending {
+			names = append(names, name)
+		}
+		return n, errgo.Newf("incomplete messages in the archive: %q", names)
+	}
+	return n, nil
+}
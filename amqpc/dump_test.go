@@ -0,0 +1,65 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestDumpLoadNumbers(t *testing.T) {
+	b := newMemBroker()
+	c := memClient(t, b, "q", 1)
+	hdr := amqp.Table{
+		"i64": int64(1<<60 + 1), "neg": int64(-1<<62 - 3), "f": 0.25,
+		"tbl": amqp.Table{"big": int64(1<<55 + 1), "f": 1.5},
+		"arr": []interface{}{int64(1<<58 + 1), 2.5},
+	}
+	if err := c.Publish("", "q", false, false, amqp.Publishing{Headers: hdr, Body: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	n, last, err := dumpQueue(c.Channel, "q", 0, &buf)
+	if err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	last.Ack(true)
+
+	b2 := newMemBroker()
+	pb, err := newPublisher(memClient(t, b2, "r", 1), spool{}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err = loadArchive(&buf, pb, "r"); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if err := pb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := b2.Messages("r")
+	if len(got) != 1 {
+		t.Fatalf("got %d messages", len(got))
+	}
+	for k, v := range hdr {
+		if g := got[0].Headers[k]; !reflect.DeepEqual(g, v) {
+			t.Errorf("%s: got %#v, wanted %#v", k, g, v)
+		}
+	}
+}
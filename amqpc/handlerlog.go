@@ -0,0 +1,278 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// handlerLogs keeps the output of the handlers, a file per message in Dir,
+// named by the message ID.
+//
+// The log of an earlier attempt of the same message is rotated to ID.log.1, ID.log.2 etc.,
+// keeping Keep of them; the logs older than Retention are removed by Expire.
+type handlerLogs struct {
+	Dir string
+	// MaxSize is the maximal size of a log file, the rest of the output is dropped.
+	MaxSize int64
+	Keep    int
+	// Retention is the time after a log file is removed.
+	Retention time.Duration
+	// Excerpt is the size of the head and the tail of the output shown in the log line.
+	Excerpt int
+
+	mu sync.Mutex // serializes rotations
+}
+
+const handlerLogSuffix = ".log"
+
+// logName returns the file name for the message ID:
+// the bytes out of [A-Za-z0-9._-] are %-escaped, and an empty ID is "-".
+func logName(messageID string) string {
+	if messageID == "" {
+		return "-" + handlerLogSuffix
+	}
+	var buf strings.Builder
+	for i := 0; i < len(messageID); i++ {
+		c := messageID[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' && i != 0 {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String() + handlerLogSuffix
+}
+
+// Path returns the path of the log of the message; the rotated ones with n > 0.
+func (hl *handlerLogs) Path(messageID string, n int) string {
+	fn := filepath.Join(hl.Dir, logName(messageID))
+	if n > 0 {
+		fn += "." + strconv.Itoa(n)
+	}
+	return fn
+}
+
+// Create rotates the earlier logs of the message, and creates a new one.
+func (hl *handlerLogs) Create(messageID string) (*handlerLog, error) {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	if err := os.MkdirAll(hl.Dir, 0750); err != nil {
+		return nil, err
+	}
+	os.Remove(hl.Path(messageID, hl.Keep))
+	for n := hl.Keep; n > 0; n-- {
+		if err := os.Rename(hl.Path(messageID, n-1), hl.Path(messageID, n)); err != nil && !os.IsNotExist(err) {
+			return nil, errgo.Notef(err, "rotate the log of %q", messageID)
+		}
+	}
+	fh, err := os.OpenFile(hl.Path(messageID, 0), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &handlerLog{fh: fh, max: hl.MaxSize, head: headWriter{Size: hl.Excerpt}, tail: tailWriter{Size: hl.Excerpt}}, nil
+}
+
+// Paths returns the existing logs of the message, the oldest first.
+func (hl *handlerLogs) Paths(messageID string) []string {
+	fn := hl.Path(messageID, 0)
+	rotated, _ := filepath.Glob(fn + ".*")
+	nums := make(map[string]int, len(rotated))
+	paths := rotated[:0]
+	for _, p := range rotated {
+		if n, err := strconv.Atoi(strings.TrimPrefix(p, fn+".")); err == nil && n > 0 {
+			nums[p] = n
+			paths = append(paths, p)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return nums[paths[i]] > nums[paths[j]] })
+	if _, err := os.Stat(fn); err == nil {
+		paths = append(paths, fn)
+	}
+	return paths
+}
+
+// Expire removes the logs older than Retention.
+func (hl *handlerLogs) Expire() error {
+	if hl.Retention <= 0 {
+		return nil
+	}
+	fis, err := ioutil.ReadDir(hl.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	limit := time.Now().Add(-hl.Retention)
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || !strings.Contains(fi.Name(), handlerLogSuffix) || !fi.ModTime().Before(limit) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(hl.Dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// printLogs copies the logs of the message to w, the oldest first,
+// or only the latest, if all is false.
+func (hl *handlerLogs) printLogs(w io.Writer, messageID string, all bool) error {
+	paths := hl.Paths(messageID)
+	if len(paths) == 0 {
+		return errgo.Newf("no log for %q in %q", messageID, hl.Dir)
+	}
+	if !all {
+		paths = paths[len(paths)-1:]
+	}
+	for _, fn := range paths {
+		if all {
+			fmt.Fprintf(w, "==> %s <==\n", fn)
+		}
+		fh, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, fh)
+		fh.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handlerLog is the log file of a handler run: the stdout and stderr of the handler,
+// in the order they're written.
+// It is safe for concurrent use.
+type handlerLog struct {
+	mu      sync.Mutex
+	fh      *os.File
+	max     int64
+	size    int64
+	dropped int64
+	// midLine is true if the file doesn't end with a newline.
+	midLine bool
+	err     error
+	head    headWriter
+	tail    tailWriter
+}
+
+// Write the output into the file till the maximal size, and keep its head and tail.
+// It never fails, so it doesn't disturb the handler: the first error is returned by Close.
+func (l *handlerLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.head.Write(p)
+	l.tail.Write(p)
+	q := p
+	if l.max > 0 && l.size+int64(len(q)) > l.max {
+		q = q[:l.max-l.size]
+	}
+	l.dropped += int64(len(p) - len(q))
+	if len(q) != 0 && l.err == nil {
+		n, err := l.fh.Write(q)
+		l.size += int64(n)
+		l.err = err
+		l.midLine = n != 0 && q[n-1] != '\n'
+	}
+	return len(p), nil
+}
+
+// Printf writes a line, e.g. about the handler, into the file.
+func (l *handlerLog) Printf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err == nil {
+		prefix := "# "
+		if l.midLine {
+			prefix = "\n# "
+		}
+		_, l.err = fmt.Fprintf(l.fh, prefix+format+"\n", args...)
+		l.midLine = false
+	}
+}
+
+// Close the log file, noting the dropped bytes.
+func (l *handlerLog) Close() error {
+	if l.dropped != 0 {
+		l.Printf("%d bytes dropped over the %d bytes limit", l.dropped, l.max)
+	}
+	err := l.fh.Close()
+	if l.err != nil {
+		return l.err
+	}
+	return err
+}
+
+// Name returns the path of the log file.
+func (l *handlerLog) Name() string { return l.fh.Name() }
+
+// Excerpt returns the output as a string if it fits in the head,
+// else its head and tail, separated by the size of the gap.
+func (l *handlerLog) Excerpt() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	total := l.size + l.dropped
+	head, tail := l.head.Bytes(), l.tail.Bytes()
+	if total <= int64(len(head)) {
+		return string(head)
+	}
+	gap := total - int64(len(head)) - int64(len(tail))
+	if gap <= 0 {
+		return string(head) + string(tail[-gap:])
+	}
+	return fmt.Sprintf("%s\n[... %d bytes ...]\n%s", head, gap, tail)
+}
+
+// headWriter keeps the first Size bytes written to it.
+type headWriter struct {
+	Size int
+	buf  []byte
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if n := h.Size - len(h.buf); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		h.buf = append(h.buf, p[:n]...)
+	}
+	return len(p), nil
+}
+
+func (h *headWriter) Bytes() []byte { return h.buf }
+
+// logOutput logs the outcome of the handler run, with an excerpt of its output.
+func logOutput(args []string, res *handlerResult, err error, l *handlerLog) {
+	log.Printf("%q finished in %s with exit code %d (error: %v), log %q: %q",
+		args, res.Duration, res.ExitCode, err, l.Name(), l.Excerpt())
+}
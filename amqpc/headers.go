@@ -0,0 +1,76 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+// parseHeaders parses the --header arguments into an amqp.Table.
+//
+// Each argument is key=value, or key:type=value, where type is one of
+// string (the default), int, float, bool or timestamp (RFC3339 or Unix seconds).
+func parseHeaders(args []string) (amqp.Table, error) {
+	tbl := make(amqp.Table, len(args))
+	for _, arg := range args {
+		i := strings.IndexByte(arg, '=')
+		if i <= 0 {
+			return nil, errgo.Newf("header %q: not in key=value form", arg)
+		}
+		key, typ, value := arg[:i], "string", arg[i+1:]
+		if j := strings.LastIndexByte(key, ':'); j >= 0 {
+			key, typ = key[:j], key[j+1:]
+		}
+		v, err := parseHeaderValue(typ, value)
+		if err != nil {
+			return nil, errgo.Notef(err, "header %q", arg)
+		}
+		tbl[key] = v
+	}
+	if err := tbl.Validate(); err != nil {
+		return nil, err
+	}
+	return tbl, nil
+}
+
+func parseHeaderValue(typ, value string) (interface{}, error) {
+	switch typ {
+	case "", "string":
+		return value, nil
+	case "int":
+		return strconv.ParseInt(value, 10, 64)
+	case "float":
+		return strconv.ParseFloat(value, 64)
+	case "bool":
+		return strconv.ParseBool(value)
+	case "timestamp", "time":
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t, nil
+		}
+		sec, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, errgo.Newf("%q is neither RFC3339, nor Unix seconds", value)
+		}
+		return time.Unix(sec, 0), nil
+	}
+	return nil, errgo.Newf("unknown type %q (string, int, float, bool or timestamp)", typ)
+}
@@ -0,0 +1,124 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// limitedExecArg is the first argument of amqpc when it is re-executed
+// to set the resource limits and the niceness of the handler, then exec it.
+const limitedExecArg = "__limited-exec"
+
+// handlerLimits restrict the handler command.
+type handlerLimits struct {
+	// Timeout is the maximal run time of the handler (0 is unlimited).
+	// On timeout, the handler's process group gets a SIGTERM,
+	// then after Grace, a SIGKILL.
+	Timeout, Grace time.Duration
+	// CPU is the CPU time limit (RLIMIT_CPU), rounded up to seconds.
+	CPU time.Duration
+	// AddressSpace is the address space limit (RLIMIT_AS) in bytes.
+	AddressSpace int64
+	// Nice is the niceness of the handler.
+	Nice int
+}
+
+// Command returns the command for args, in its own process group,
+// wrapped by amqpc itself if resource limits or a niceness are set.
+func (l handlerLimits) Command(args []string) (*exec.Cmd, error) {
+	if l.CPU <= 0 && l.AddressSpace <= 0 && l.Nice == 0 {
+		cmd := exec.Command(args[0], args[1:]...)
+		setProcessGroup(cmd)
+		return cmd, nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, errgo.Notef(err, "find the amqpc executable")
+	}
+	cpu := int64((l.CPU + time.Second - 1) / time.Second)
+	cmd := exec.Command(self, append([]string{limitedExecArg,
+		strconv.FormatInt(cpu, 10), strconv.FormatInt(l.AddressSpace, 10), strconv.Itoa(l.Nice)},
+		args...)...)
+	setProcessGroup(cmd)
+	return cmd, nil
+}
+
+// within returns the limits with the Timeout cut to the time left till the deadline of ctx,
+// or the error of ctx if it is done already.
+func (l handlerLimits) within(ctx context.Context) (handlerLimits, error) {
+	if err := ctx.Err(); err != nil {
+		return l, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return l, nil
+	}
+	left := time.Until(deadline)
+	if left <= 0 {
+		return l, context.DeadlineExceeded
+	}
+	if l.Timeout <= 0 || left < l.Timeout {
+		l.Timeout = left
+	}
+	return l, nil
+}
+
+// Run starts cmd and waits for it to finish, killing its process group on timeout.
+func (l handlerLimits) Run(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	if l.Timeout <= 0 {
+		return <-done
+	}
+	timer := time.NewTimer(l.Timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+
+	log.Printf("%q timed out after %s, terminating it.", cmd.Args, l.Timeout)
+	if err := signalGroup(cmd, syscall.SIGTERM); err != nil {
+		log.Printf("SIGTERM %d: %v", cmd.Process.Pid, err)
+	}
+	grace := time.NewTimer(l.Grace)
+	defer grace.Stop()
+	select {
+	case <-done:
+		// kill the rest of the group, too
+		signalGroup(cmd, syscall.SIGKILL)
+	case <-grace.C:
+		log.Printf("%q is still running after %s, killing it.", cmd.Args, l.Grace)
+		if err := signalGroup(cmd, syscall.SIGKILL); err != nil {
+			log.Printf("SIGKILL %d: %v", cmd.Process.Pid, err)
+		}
+		<-done
+	}
+	return errgo.Newf("timed out after %s", l.Timeout)
+}
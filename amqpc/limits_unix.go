@@ -0,0 +1,84 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"github.com/spf13/pflag"
+)
+
+// disableLimitFlags does nothing, as the handler limits are supported here.
+func disableLimitFlags(f *pflag.FlagSet) {}
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalGroup sends sig to the process group of cmd.
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
+
+// execLimited sets the resource limits and the niceness given in args
+// (CPU seconds, address space bytes, niceness), then execs the rest of args.
+//
+// It never returns.
+func execLimited(args []string) {
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "amqpc %s: %v\n", limitedExecArg, err)
+		os.Exit(127)
+	}
+	if len(args) < 4 {
+		fail(fmt.Errorf("needs CPU, AS, NICE and the command, got %q", args))
+	}
+	var nums [3]int64
+	for i := range nums {
+		n, err := strconv.ParseInt(args[i], 10, 64)
+		if err != nil {
+			fail(err)
+		}
+		nums[i] = n
+	}
+	if cpu := nums[0]; cpu > 0 {
+		// SIGXCPU at the soft limit, SIGKILL a second later
+		if err := syscall.Setrlimit(syscall.RLIMIT_CPU, &syscall.Rlimit{Cur: uint64(cpu), Max: uint64(cpu) + 1}); err != nil {
+			fail(fmt.Errorf("RLIMIT_CPU: %v", err))
+		}
+	}
+	if as := nums[1]; as > 0 {
+		if err := syscall.Setrlimit(syscall.RLIMIT_AS, &syscall.Rlimit{Cur: uint64(as), Max: uint64(as)}); err != nil {
+			fail(fmt.Errorf("RLIMIT_AS: %v", err))
+		}
+	}
+	if nice := int(nums[2]); nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, nice); err != nil {
+			fail(fmt.Errorf("setpriority(%d): %v", nice, err))
+		}
+	}
+	path, err := exec.LookPath(args[3])
+	if err != nil {
+		fail(err)
+	}
+	fail(syscall.Exec(path, args[3:], os.Environ()))
+}
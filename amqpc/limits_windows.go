@@ -0,0 +1,61 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/errgo.v1"
+)
+
+// limitFlags are the flags of the handler limits, which are not supported here.
+var limitFlags = []string{"handler-timeout", "handler-kill-grace", "handler-cpu", "handler-memory", "handler-nice"}
+
+// disableLimitFlags makes setting any of the limitFlags of f an error.
+func disableLimitFlags(f *pflag.FlagSet) {
+	for _, name := range limitFlags {
+		if fl := f.Lookup(name); fl != nil {
+			fl.Value = unsupportedValue{fl.Value}
+			fl.Usage += " (not supported on windows)"
+		}
+	}
+}
+
+// unsupportedValue is a flag value which can't be set.
+type unsupportedValue struct {
+	pflag.Value
+}
+
+func (unsupportedValue) Set(string) error { return errgo.New("not supported on windows") }
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalGroup kills the process of cmd, as there are no process groups and signals here.
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	return cmd.Process.Kill()
+}
+
+func execLimited(args []string) {
+	fmt.Fprintf(os.Stderr, "amqpc %s: resource limits are not supported on Windows\n", limitedExecArg)
+	os.Exit(127)
+}
@@ -0,0 +1,1008 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// memBroker is an in-memory AMQP broker, for exercising amqpc without RabbitMQ.
+//
+// It has the default, direct, fanout, topic and headers exchanges, and queues
+// with x-message-ttl, x-dead-letter-exchange, x-dead-letter-routing-key,
+// x-max-length and x-overflow arguments; publisher confirms, mandatory returns,
+// consumer prefetch, acks, nacks and redelivery.
+// Channel errors (e.g. redeclaring a queue with different arguments)
+// close the channel, as with a real broker.
+//
+// The queues survive the connections (see Disconnect), except the exclusive ones.
+type memBroker struct {
+	mu sync.Mutex
+	// cond is broadcast on each change the consumers may wait for.
+	cond      *sync.Cond
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	conns     map[*memConn]struct{}
+	// seq numbers the generated queue names and consumer tags.
+	seq int
+}
+
+type memExchange struct {
+	Kind                string
+	Durable, AutoDelete bool
+	Bindings            []memBinding
+}
+
+type memBinding struct {
+	Queue, Key string
+	Args       amqp.Table
+}
+
+type memQueue struct {
+	Name                           string
+	Durable, AutoDelete, Exclusive bool
+	Args                           amqp.Table
+
+	owner     *memConn
+	ready     []memMessage
+	consumers int
+}
+
+type memMessage struct {
+	amqp.Publishing
+	Exchange, Key string
+	Redelivered   bool
+	expires       time.Time
+}
+
+// newMemBroker returns an empty broker, with the amq.* exchanges.
+func newMemBroker() *memBroker {
+	b := &memBroker{
+		exchanges: make(map[string]*memExchange),
+		queues:    make(map[string]*memQueue),
+		conns:     make(map[*memConn]struct{}),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	for _, kind := range []string{amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders} {
+		b.exchanges["amq."+kind] = &memExchange{Kind: kind, Durable: true}
+	}
+	return b
+}
+
+// Dial returns a new connection to the broker, as the guest user.
+func (b *memBroker) Dial() *memConn { return b.DialUser("guest") }
+
+// DialUser returns a new connection to the broker, as user.
+func (b *memBroker) DialUser(user string) *memConn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := &memConn{b: b, user: user, channels: make(map[*memChannel]struct{})}
+	b.conns[c] = struct{}{}
+	return c
+}
+
+// Disconnect closes all the connections with a connection-forced error,
+// as a broker restart would.
+func (b *memBroker) Disconnect() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		c.close(&amqp.Error{Code: amqp.ConnectionForced, Reason: "broker shutdown", Server: true})
+	}
+}
+
+// Messages returns the messages ready in the named queue.
+func (b *memBroker) Messages(queue string) []amqp.Publishing {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queues[queue]
+	if q == nil {
+		return nil
+	}
+	b.expire(time.Now())
+	msgs := make([]amqp.Publishing, len(q.ready))
+	for i, m := range q.ready {
+		msgs[i] = m.Publishing
+	}
+	return msgs
+}
+
+// route returns the queues msg goes to through the exchange with key.
+func (b *memBroker) route(exchange, key string, headers amqp.Table) ([]*memQueue, *amqp.Error) {
+	if exchange == "" {
+		if q := b.queues[key]; q != nil {
+			return []*memQueue{q}, nil
+		}
+		return nil, nil
+	}
+	e := b.exchanges[exchange]
+	if e == nil {
+		return nil, &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("no exchange %q", exchange)}
+	}
+	var qs []*memQueue
+	seen := make(map[string]bool)
+	for _, bnd := range e.Bindings {
+		var ok bool
+		switch e.Kind {
+		case amqp.ExchangeFanout:
+			ok = true
+		case amqp.ExchangeDirect:
+			ok = bnd.Key == key
+		case amqp.ExchangeTopic:
+			ok = topicMatch(strings.Split(bnd.Key, "."), strings.Split(key, "."))
+		case amqp.ExchangeHeaders:
+			ok = headersMatch(bnd.Args, headers)
+		}
+		if ok && !seen[bnd.Queue] {
+			seen[bnd.Queue] = true
+			qs = append(qs, b.queues[bnd.Queue])
+		}
+	}
+	return qs, nil
+}
+
+// topicMatch reports whether the words of the key match the pattern,
+// where * matches one word, # zero or more.
+func topicMatch(pattern, key []string) bool {
+	for len(pattern) != 0 {
+		if pattern[0] == "#" {
+			for i := 0; i <= len(key); i++ {
+				if topicMatch(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(key) == 0 || pattern[0] != "*" && pattern[0] != key[0] {
+			return false
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return len(key) == 0
+}
+
+// headersMatch reports whether the headers match the binding's arguments,
+// all of them, or any with x-match=any.
+func headersMatch(args, headers amqp.Table) bool {
+	matchAny := headerString(args["x-match"]) == "any"
+	for k, v := range args {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+		h, ok := headers[k]
+		ok = ok && fmt.Sprint(h) == fmt.Sprint(v)
+		if ok && matchAny {
+			return true
+		}
+		if !ok && !matchAny {
+			return false
+		}
+	}
+	return !matchAny
+}
+
+// enqueue puts m into q. Returns false if q is full and rejects publishes.
+func (b *memBroker) enqueue(q *memQueue, m memMessage) bool {
+	if max, ok := headerInt(q.Args["x-max-length"]); ok && int64(len(q.ready)) >= max {
+		if headerString(q.Args["x-overflow"]) == "reject-publish" {
+			return false
+		}
+		for int64(len(q.ready)) >= max && len(q.ready) != 0 {
+			head := q.ready[0]
+			q.ready = q.ready[1:]
+			b.deadLetter(q, head, "maxlen")
+		}
+		if max <= 0 {
+			b.deadLetter(q, m, "maxlen")
+			return true
+		}
+	}
+	now := time.Now()
+	var ttl time.Duration
+	if ms, ok := headerInt(q.Args["x-message-ttl"]); ok {
+		ttl = time.Duration(ms) * time.Millisecond
+	}
+	if ms, err := strconv.ParseInt(m.Expiration, 10, 64); err == nil && (ttl == 0 || time.Duration(ms)*time.Millisecond < ttl) {
+		ttl = time.Duration(ms) * time.Millisecond
+	}
+	m.expires = time.Time{}
+	if ttl > 0 {
+		m.expires = now.Add(ttl)
+		time.AfterFunc(ttl, func() {
+			b.mu.Lock()
+			b.expire(time.Now())
+			b.mu.Unlock()
+		})
+	}
+	// copy, as the routes of a message may share it
+	headers := make(amqp.Table, len(m.Headers))
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	m.Headers = headers
+	q.ready = append(q.ready, m)
+	b.cond.Broadcast()
+	return true
+}
+
+// expire dead-letters the messages expired by now.
+func (b *memBroker) expire(now time.Time) {
+	for _, q := range b.queues {
+		ready := q.ready[:0]
+		var expired []memMessage
+		for _, m := range q.ready {
+			if !m.expires.IsZero() && !m.expires.After(now) {
+				expired = append(expired, m)
+				continue
+			}
+			ready = append(ready, m)
+		}
+		q.ready = ready
+		for _, m := range expired {
+			b.deadLetter(q, m, "expired")
+		}
+	}
+	b.cond.Broadcast()
+}
+
+// deadLetter routes m through the dead-letter exchange of q, or drops it if q has none.
+func (b *memBroker) deadLetter(q *memQueue, m memMessage, reason string) {
+	dlx, ok := q.Args["x-dead-letter-exchange"]
+	if !ok {
+		return
+	}
+	key := m.Key
+	if k, ok := q.Args["x-dead-letter-routing-key"]; ok {
+		key = headerString(k)
+	}
+	headers := make(amqp.Table, len(m.Headers)+3)
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	if _, ok := headers["x-first-death-queue"]; !ok {
+		headers["x-first-death-queue"] = q.Name
+		headers["x-first-death-reason"] = reason
+		headers["x-first-death-exchange"] = m.Exchange
+	}
+	m.Headers, m.Expiration, m.Redelivered = headers, "", false
+	qs, _ := b.route(headerString(dlx), key, headers)
+	m.Exchange, m.Key = headerString(dlx), key
+	for _, dq := range qs {
+		if dq != q {
+			b.enqueue(dq, m)
+		}
+	}
+}
+
+// memConn is a connection to the memBroker. It implements Broker.
+type memConn struct {
+	b        *memBroker
+	user     string
+	closed   bool
+	channels map[*memChannel]struct{}
+	closes   []chan *amqp.Error
+}
+
+func (c *memConn) Channel() (Channel, error) {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &memChannel{
+		b: c.b, conn: c,
+		unacked:   make(map[uint64]memUnacked),
+		consumers: make(map[string]*memConsumer),
+		notes:     newNotifier(),
+	}
+	c.channels[ch] = struct{}{}
+	return ch, nil
+}
+
+func (c *memConn) NotifyClose(ch chan *amqp.Error) chan *amqp.Error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if c.closed {
+		close(ch)
+		return ch
+	}
+	c.closes = append(c.closes, ch)
+	return ch
+}
+
+func (c *memConn) Close() error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.close(nil)
+	return nil
+}
+
+// close the connection with its channels, and delete its exclusive queues.
+// The NotifyClose channels get err, if not nil.
+func (c *memConn) close(err *amqp.Error) {
+	c.closed = true
+	for ch := range c.channels {
+		ch.close(err)
+	}
+	for name, q := range c.b.queues {
+		if q.owner == c {
+			delete(c.b.queues, name)
+		}
+	}
+	delete(c.b.conns, c)
+	closes := c.closes
+	c.closes = nil
+	go func() {
+		for _, ch := range closes {
+			if err != nil {
+				ch <- err
+			}
+			close(ch)
+		}
+	}()
+}
+
+// memChannel is a channel on a memConn. It implements Channel and amqp.Acknowledger.
+type memChannel struct {
+	b      *memBroker
+	conn   *memConn
+	closed bool
+
+	prefetch    int
+	confirming  bool
+	publishSeq  uint64
+	deliveryTag uint64
+	unacked     map[uint64]memUnacked
+	consumers   map[string]*memConsumer
+
+	// notes delivers the confirms, returns and the closing in order,
+	// without holding the broker's lock.
+	notes    *notifier
+	confirms []chan amqp.Confirmation
+	returns  []chan amqp.Return
+	closes   []chan *amqp.Error
+}
+
+type memUnacked struct {
+	queue *memQueue
+	memMessage
+}
+
+type memConsumer struct {
+	tag       string
+	queue     *memQueue
+	autoAck   bool
+	cancelled bool
+	done      chan struct{}
+}
+
+// fail closes the channel with the channel exception, and returns it.
+func (ch *memChannel) fail(code int, format string, args ...interface{}) error {
+	err := &amqp.Error{Code: code, Reason: fmt.Sprintf(format, args...), Server: true}
+	ch.close(err)
+	return err
+}
+
+func (ch *memChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.prefetch = prefetchCount
+	ch.b.cond.Broadcast()
+	return nil
+}
+
+func (ch *memChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if name == "" {
+		return ch.fail(amqp.AccessRefused, "the default exchange cannot be declared")
+	}
+	if err := checkExchangeType(kind); err != nil {
+		return ch.fail(amqp.CommandInvalid, "%v", err)
+	}
+	if e := ch.b.exchanges[name]; e != nil {
+		if e.Kind != kind || e.Durable != durable || e.AutoDelete != autoDelete {
+			return ch.fail(amqp.PreconditionFailed, "inequivalent arg for exchange %q", name)
+		}
+		return nil
+	}
+	ch.b.exchanges[name] = &memExchange{Kind: kind, Durable: durable, AutoDelete: autoDelete}
+	return nil
+}
+
+func (ch *memChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		ch.b.seq++
+		name = fmt.Sprintf("amq.gen-%d", ch.b.seq)
+	}
+	q := ch.b.queues[name]
+	if q == nil {
+		q = &memQueue{Name: name, Durable: durable, AutoDelete: autoDelete, Exclusive: exclusive, Args: args}
+		if exclusive {
+			q.owner = ch.conn
+		}
+		ch.b.queues[name] = q
+	} else if q.Exclusive && q.owner != ch.conn {
+		return amqp.Queue{}, ch.fail(amqp.ResourceLocked, "queue %q is exclusive to another connection", name)
+	} else if q.Durable != durable || q.AutoDelete != autoDelete || q.Exclusive != exclusive || !tablesEqual(q.Args, args) {
+		return amqp.Queue{}, ch.fail(amqp.PreconditionFailed, "inequivalent arg for queue %q", name)
+	}
+	return amqp.Queue{Name: name, Messages: len(q.ready), Consumers: q.consumers}, nil
+}
+
+func (ch *memChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return ch.QueueInspect(name)
+}
+
+func (ch *memChannel) QueueInspect(name string) (amqp.Queue, error) {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	q, err := ch.queue(name)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	ch.b.expire(time.Now())
+	return amqp.Queue{Name: name, Messages: len(q.ready), Consumers: q.consumers}, nil
+}
+
+func (ch *memChannel) QueuePurge(name string, noWait bool) (int, error) {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	q, err := ch.queue(name)
+	if err != nil {
+		return 0, err
+	}
+	n := len(q.ready)
+	q.ready = nil
+	return n, nil
+}
+
+// queue returns the named queue, which must exist, and be accessible to the channel's connection.
+func (ch *memChannel) queue(name string) (*memQueue, error) {
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	q := ch.b.queues[name]
+	if q == nil {
+		return nil, ch.fail(amqp.NotFound, "no queue %q", name)
+	}
+	if q.Exclusive && q.owner != ch.conn {
+		return nil, ch.fail(amqp.ResourceLocked, "queue %q is exclusive to another connection", name)
+	}
+	return q, nil
+}
+
+// tablesEqual reports whether the tables have the same keys with the same values,
+// regardless of the integer types.
+func tablesEqual(a, b amqp.Table) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		w, ok := b[k]
+		if !ok || fmt.Sprint(v) != fmt.Sprint(w) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ch *memChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if exchange == "" {
+		return ch.fail(amqp.AccessRefused, "cannot bind to the default exchange")
+	}
+	e := ch.b.exchanges[exchange]
+	if e == nil {
+		return ch.fail(amqp.NotFound, "no exchange %q", exchange)
+	}
+	if ch.b.queues[name] == nil {
+		return ch.fail(amqp.NotFound, "no queue %q", name)
+	}
+	for _, bnd := range e.Bindings {
+		if bnd.Queue == name && bnd.Key == key && tablesEqual(bnd.Args, args) {
+			return nil
+		}
+	}
+	e.Bindings = append(e.Bindings, memBinding{Queue: name, Key: key, Args: args})
+	return nil
+}
+
+func (ch *memChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	q, err := ch.queue(queue)
+	if err != nil {
+		return nil, err
+	}
+	if consumer == "" {
+		ch.b.seq++
+		consumer = fmt.Sprintf("ctag-%d", ch.b.seq)
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, ch.fail(amqp.NotAllowed, "consumer tag %q is used already", consumer)
+	}
+	cs := &memConsumer{tag: consumer, queue: q, autoAck: autoAck, done: make(chan struct{})}
+	ch.consumers[consumer] = cs
+	q.consumers++
+	out := make(chan amqp.Delivery)
+	go ch.deliver(cs, out)
+	return out, nil
+}
+
+// deliver sends the messages of the consumer's queue to out,
+// respecting the prefetch count, till the consumer is cancelled.
+func (ch *memChannel) deliver(cs *memConsumer, out chan<- amqp.Delivery) {
+	defer close(out)
+	b := ch.b
+	q := cs.queue
+	for {
+		b.mu.Lock()
+		for !cs.cancelled && (len(q.ready) == 0 || !cs.autoAck && ch.prefetch > 0 && len(ch.unacked) >= ch.prefetch) {
+			b.cond.Wait()
+		}
+		if cs.cancelled {
+			b.mu.Unlock()
+			return
+		}
+		m := q.ready[0]
+		q.ready = q.ready[1:]
+		ch.deliveryTag++
+		tag := ch.deliveryTag
+		if !cs.autoAck {
+			ch.unacked[tag] = memUnacked{queue: q, memMessage: m}
+		}
+		d := deliveryOf(m)
+		d.Acknowledger, d.ConsumerTag, d.DeliveryTag = ch, cs.tag, tag
+		b.mu.Unlock()
+
+		select {
+		case out <- d:
+		case <-cs.done:
+			// give it back, unless the closing of the channel did already
+			b.mu.Lock()
+			if _, ok := ch.unacked[tag]; ok || cs.autoAck {
+				delete(ch.unacked, tag)
+				m.Redelivered = true
+				q.ready = append([]memMessage{m}, q.ready...)
+				b.cond.Broadcast()
+			}
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (ch *memChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	q, err := ch.queue(queue)
+	if err != nil {
+		return amqp.Delivery{}, false, err
+	}
+	ch.b.expire(time.Now())
+	if len(q.ready) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	m := q.ready[0]
+	q.ready = q.ready[1:]
+	ch.deliveryTag++
+	if !autoAck {
+		ch.unacked[ch.deliveryTag] = memUnacked{queue: q, memMessage: m}
+	}
+	d := deliveryOf(m)
+	d.Acknowledger, d.DeliveryTag, d.MessageCount = ch, ch.deliveryTag, uint32(len(q.ready))
+	return d, true, nil
+}
+
+func deliveryOf(m memMessage) amqp.Delivery {
+	return amqp.Delivery{
+		Headers:         m.Headers,
+		ContentType:     m.ContentType,
+		ContentEncoding: m.ContentEncoding,
+		DeliveryMode:    m.DeliveryMode,
+		Priority:        m.Priority,
+		CorrelationId:   m.CorrelationId,
+		ReplyTo:         m.ReplyTo,
+		Expiration:      m.Expiration,
+		MessageId:       m.MessageId,
+		Timestamp:       m.Timestamp,
+		Type:            m.Type,
+		UserId:          m.UserId,
+		AppId:           m.AppId,
+		Redelivered:     m.Redelivered,
+		Exchange:        m.Exchange,
+		RoutingKey:      m.Key,
+		Body:            m.Body,
+	}
+}
+
+func (ch *memChannel) Cancel(consumer string, noWait bool) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.cancel(consumer)
+	return nil
+}
+
+func (ch *memChannel) cancel(consumer string) {
+	cs := ch.consumers[consumer]
+	if cs == nil {
+		return
+	}
+	delete(ch.consumers, consumer)
+	cs.cancelled = true
+	close(cs.done)
+	q := cs.queue
+	if q.consumers--; q.consumers == 0 && q.AutoDelete && ch.b.queues[q.Name] == q {
+		delete(ch.b.queues, q.Name)
+	}
+	ch.b.cond.Broadcast()
+}
+
+func (ch *memChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if msg.UserId != "" && msg.UserId != ch.conn.user {
+		return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - user_id property set to '%s' but authenticated user was '%s'", msg.UserId, ch.conn.user)
+	}
+	qs, aerr := ch.b.route(exchange, key, msg.Headers)
+	if aerr != nil {
+		ch.close(aerr)
+		return aerr
+	}
+	ack := true
+	for _, q := range qs {
+		if !ch.b.enqueue(q, memMessage{Publishing: msg, Exchange: exchange, Key: key}) {
+			ack = false
+		}
+	}
+	if len(qs) == 0 && mandatory {
+		ret := amqp.Return{
+			ReplyCode: amqp.NoRoute, ReplyText: "NO_ROUTE", Exchange: exchange, RoutingKey: key,
+			Headers: msg.Headers, ContentType: msg.ContentType, ContentEncoding: msg.ContentEncoding,
+			DeliveryMode: msg.DeliveryMode, Priority: msg.Priority, CorrelationId: msg.CorrelationId,
+			ReplyTo: msg.ReplyTo, Expiration: msg.Expiration, MessageId: msg.MessageId,
+			Timestamp: msg.Timestamp, Type: msg.Type, UserId: msg.UserId, AppId: msg.AppId,
+			Body: msg.Body,
+		}
+		returns := ch.returns
+		ch.notes.Push(func() {
+			for _, c := range returns {
+				c <- ret
+			}
+		})
+	}
+	if ch.confirming {
+		ch.publishSeq++
+		conf := amqp.Confirmation{DeliveryTag: ch.publishSeq, Ack: ack}
+		confirms := ch.confirms
+		ch.notes.Push(func() {
+			for _, c := range confirms {
+				c <- conf
+			}
+		})
+	}
+	return nil
+}
+
+func (ch *memChannel) Confirm(noWait bool) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirming = true
+	return nil
+}
+
+func (ch *memChannel) NotifyPublish(c chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		close(c)
+		return c
+	}
+	ch.confirms = append(ch.confirms, c)
+	return c
+}
+
+func (ch *memChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		close(c)
+		return c
+	}
+	ch.returns = append(ch.returns, c)
+	return c
+}
+
+func (ch *memChannel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		close(c)
+		return c
+	}
+	ch.closes = append(ch.closes, c)
+	return c
+}
+
+func (ch *memChannel) Close() error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.close(nil)
+	return nil
+}
+
+// close the channel: cancel the consumers, requeue the unacked messages,
+// and close the notification channels (sending err to the NotifyClose ones, if not nil).
+func (ch *memChannel) close(err *amqp.Error) {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	delete(ch.conn.channels, ch)
+	for tag := range ch.consumers {
+		ch.cancel(tag)
+	}
+	ch.requeue(ch.unackedTags(^uint64(0), true))
+	confirms, returns, closes := ch.confirms, ch.returns, ch.closes
+	ch.confirms, ch.returns, ch.closes = nil, nil, nil
+	ch.notes.Close(func() {
+		for _, c := range closes {
+			if err != nil {
+				c <- err
+			}
+			close(c)
+		}
+		for _, c := range confirms {
+			close(c)
+		}
+		for _, c := range returns {
+			close(c)
+		}
+	})
+}
+
+// unackedTags returns the unacked delivery tags up to tag (if multiple), or just tag, in order.
+func (ch *memChannel) unackedTags(tag uint64, multiple bool) []uint64 {
+	if !multiple {
+		if _, ok := ch.unacked[tag]; !ok {
+			return nil
+		}
+		return []uint64{tag}
+	}
+	tags := make([]uint64, 0, len(ch.unacked))
+	for t := range ch.unacked {
+		if t <= tag {
+			tags = append(tags, t)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	return tags
+}
+
+// requeue puts the unacked messages back to the front of their queues, in order.
+func (ch *memChannel) requeue(tags []uint64) {
+	for i := len(tags) - 1; i >= 0; i-- {
+		u := ch.unacked[tags[i]]
+		delete(ch.unacked, tags[i])
+		u.Redelivered = true
+		u.queue.ready = append([]memMessage{u.memMessage}, u.queue.ready...)
+	}
+	ch.b.cond.Broadcast()
+}
+
+// settle is the common part of Ack, Nack and Reject.
+func (ch *memChannel) settle(tag uint64, multiple, ack, requeue bool) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	tags := ch.unackedTags(tag, multiple)
+	if len(tags) == 0 {
+		return ch.fail(amqp.PreconditionFailed, "unknown delivery tag %d", tag)
+	}
+	if !ack && requeue {
+		ch.requeue(tags)
+		return nil
+	}
+	for _, t := range tags {
+		u := ch.unacked[t]
+		delete(ch.unacked, t)
+		if !ack {
+			ch.b.deadLetter(u.queue, u.memMessage, "rejected")
+		}
+	}
+	ch.b.cond.Broadcast()
+	return nil
+}
+
+func (ch *memChannel) Ack(tag uint64, multiple bool) error {
+	return ch.settle(tag, multiple, true, false)
+}
+
+func (ch *memChannel) Nack(tag uint64, multiple, requeue bool) error {
+	return ch.settle(tag, multiple, false, requeue)
+}
+
+func (ch *memChannel) Reject(tag uint64, requeue bool) error {
+	return ch.settle(tag, false, false, requeue)
+}
+
+// notifier calls the pushed functions in order, on its own goroutine.
+type notifier struct {
+	mu     sync.Mutex
+	queue  []func()
+	closed bool
+	wake   chan struct{}
+}
+
+func newNotifier() *notifier {
+	n := &notifier{wake: make(chan struct{}, 1)}
+	go n.run()
+	return n
+}
+
+// Push f to be called after the previously pushed ones.
+func (n *notifier) Push(f func()) {
+	n.mu.Lock()
+	n.queue = append(n.queue, f)
+	n.mu.Unlock()
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close pushes the last function, and stops the notifier after calling it.
+func (n *notifier) Close(last func()) {
+	n.mu.Lock()
+	n.queue = append(n.queue, last)
+	n.closed = true
+	n.mu.Unlock()
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (n *notifier) run() {
+	for {
+		n.mu.Lock()
+		queue, closed := n.queue, n.closed
+		n.queue = nil
+		n.mu.Unlock()
+		for _, f := range queue {
+			f()
+		}
+		if closed {
+			return
+		}
+		<-n.wake
+	}
+}
+
+func TestMemReturnsRedelivery(t *testing.T) {
+	b := newMemBroker()
+	c := memClient(t, b, "", 1)
+	c.Confirm(false)
+	rets := c.NotifyReturn(make(chan amqp.Return, 1))
+	confs := c.NotifyPublish(make(chan amqp.Confirmation, 1))
+	c.Publish("", "nowhere", true, false, amqp.Publishing{Body: []byte("x")})
+	if r := <-rets; r.ReplyCode != amqp.NoRoute {
+		t.Error(r)
+	}
+	if cf := <-confs; !cf.Ack || cf.DeliveryTag != 1 {
+		t.Error(cf)
+	}
+	c.QueueDeclare("q", true, false, false, false, nil)
+	c.Publish("", "q", false, false, amqp.Publishing{Body: []byte("1")})
+	<-confs
+	c.Publish("", "q", false, false, amqp.Publishing{Body: []byte("2")})
+	<-confs
+
+	c2 := memClient(t, b, "q", 1)
+	d, _ := c2.Consume("q", "", false, false, false, false, nil)
+	m := <-d
+	if string(m.Body) != "1" {
+		t.Fatal(string(m.Body))
+	}
+	closed := c2.Broker.NotifyClose(make(chan *amqp.Error, 1))
+	b.Disconnect()
+	if err := <-closed; err == nil || err.Code != amqp.ConnectionForced {
+		t.Error(err)
+	}
+	for range d {
+	}
+	c3 := memClient(t, b, "q", 5)
+	d, _ = c3.Consume("q", "", false, false, false, false, nil)
+	m = <-d
+	if string(m.Body) != "1" || !m.Redelivered {
+		t.Errorf("%q %t", m.Body, m.Redelivered)
+	}
+	m.Nack(false, true)
+	m2 := <-d
+	m = <-d
+	if string(m.Body) != "1" || string(m2.Body) != "2" || !m.Redelivered {
+		t.Errorf("%q %q", m.Body, m2.Body)
+	}
+	m.Ack(true)
+	if _, err := c3.QueueDeclare("q", false, false, false, false, nil); err == nil {
+		t.Error("no precondition failure")
+	}
+	if err := m2.Ack(false); err != amqp.ErrClosed {
+		t.Error(err)
+	}
+	if n := len(b.Messages("q")); n != 0 {
+		t.Errorf("%d left", n)
+	}
+}
+
+func TestMemTopic(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, key string
+		ok           bool
+	}{
+		{"#", "a.b", true},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b.c", false},
+		{"a.#.c", "a.c", true},
+		{"a.#.c", "a.x.y.c", true},
+		{"*.b", "b", false},
+	} {
+		if got := topicMatch(strings.Split(tc.pattern, "."), strings.Split(tc.key, ".")); got != tc.ok {
+			t.Errorf("%q %q: got %t", tc.pattern, tc.key, got)
+		}
+	}
+}
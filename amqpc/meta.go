@@ -0,0 +1,146 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// messageMeta is the metadata of a message, as written into the JSON sidecar file.
+type messageMeta struct {
+	MessageId       string                 `json:"messageId,omitempty"`
+	CorrelationId   string                 `json:"correlationId,omitempty"`
+	ReplyTo         string                 `json:"replyTo,omitempty"`
+	Type            string                 `json:"type,omitempty"`
+	ContentType     string                 `json:"contentType,omitempty"`
+	ContentEncoding string                 `json:"contentEncoding,omitempty"`
+	AppId           string                 `json:"appId,omitempty"`
+	UserId          string                 `json:"userId,omitempty"`
+	Timestamp       time.Time              `json:"timestamp,omitempty"`
+	Priority        uint8                  `json:"priority,omitempty"`
+	Redelivered     bool                   `json:"redelivered"`
+	Exchange        string                 `json:"exchange,omitempty"`
+	RoutingKey      string                 `json:"routingKey,omitempty"`
+	Headers         map[string]interface{} `json:"headers,omitempty"`
+}
+
+func metaOf(msg amqp.Delivery) messageMeta {
+	return messageMeta{
+		MessageId:       msg.MessageId,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Type:            msg.Type,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		AppId:           msg.AppId,
+		UserId:          msg.UserId,
+		Timestamp:       msg.Timestamp,
+		Priority:        msg.Priority,
+		Redelivered:     msg.Redelivered,
+		Exchange:        msg.Exchange,
+		RoutingKey:      msg.RoutingKey,
+		Headers:         msg.Headers,
+	}
+}
+
+// writeSidecar writes the metadata of msg as JSON to fn.
+func writeSidecar(fn string, msg amqp.Delivery) error {
+	b, err := json.MarshalIndent(metaOf(msg), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fn, append(b, '\n'))
+}
+
+// messageEnv returns the metadata of msg as environment variables for the handler:
+// AMQP_MESSAGE_ID, AMQP_CONTENT_TYPE, AMQP_APP_ID, AMQP_TIMESTAMP, AMQP_REDELIVERED etc.,
+// and AMQP_HEADER_<NAME> for each header, NAME uppercased with non-alphanumerics replaced by _.
+func messageEnv(msg amqp.Delivery) []string {
+	env := make([]string, 0, 16+len(msg.Headers))
+	add := func(k, v string) {
+		if v != "" {
+			env = append(env, "AMQP_"+k+"="+v)
+		}
+	}
+	add("MESSAGE_ID", msg.MessageId)
+	add("CORRELATION_ID", msg.CorrelationId)
+	add("REPLY_TO", msg.ReplyTo)
+	add("TYPE", msg.Type)
+	add("CONTENT_TYPE", msg.ContentType)
+	add("CONTENT_ENCODING", msg.ContentEncoding)
+	add("APP_ID", msg.AppId)
+	add("USER_ID", msg.UserId)
+	if !msg.Timestamp.IsZero() {
+		add("TIMESTAMP", msg.Timestamp.Format(time.RFC3339))
+	}
+	if msg.Priority != 0 {
+		add("PRIORITY", strconv.Itoa(int(msg.Priority)))
+	}
+	add("REDELIVERED", strconv.FormatBool(msg.Redelivered))
+	add("EXCHANGE", msg.Exchange)
+	add("ROUTING_KEY", msg.RoutingKey)
+
+	keys := make([]string, 0, len(msg.Headers))
+	for k := range msg.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		add("HEADER_"+envName(k), headerString(msg.Headers[k]))
+	}
+	return env
+}
+
+// envName returns k uppercased, with every non-alphanumeric character replaced by _.
+func envName(k string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, k)
+}
+
+// headerString returns the string representation of an amqp.Table field.
+func headerString(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	case time.Time:
+		return x.Format(time.RFC3339)
+	case amqp.Table, []interface{}:
+		b, err := json.Marshal(x)
+		if err != nil {
+			return fmt.Sprintf("%v", x)
+		}
+		return string(b)
+	}
+	return fmt.Sprintf("%v", v)
+}
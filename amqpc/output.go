@@ -0,0 +1,177 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+// defaultNameTemplate is the default of --name-template.
+const defaultNameTemplate = "{{.FileName}}"
+
+// outputName is the data the --name-template is executed with.
+//
+// Besides the message's metadata (e.g. {{.AppId}}, {{.Timestamp}}, {{index .Headers "x"}}),
+// it has the sanitized FileName, and the Seq number of the message.
+type outputName struct {
+	messageMeta
+	// FileName is the base name from the FileName header,
+	// or the sequence number with the extension of the content type.
+	FileName string
+	// Ext is the extension of FileName.
+	Ext string
+	Seq uint64
+}
+
+func outputNameOf(msg amqp.Delivery, seq uint64) outputName {
+	on := outputName{messageMeta: metaOf(msg), Seq: seq}
+	if on.Timestamp.IsZero() {
+		on.Timestamp = time.Now()
+	}
+	on.FileName = sanitizeName(headerString(msg.Headers["FileName"]))
+	if on.FileName == "" {
+		var ext string
+		if exts, err := mime.ExtensionsByType(msg.ContentType); err != nil {
+			log.Printf("Extension for %q: %v", msg.ContentType, err)
+		} else if len(exts) > 0 {
+			ext = exts[0]
+		}
+		on.FileName = fmt.Sprintf("%09d%s", seq, ext)
+	}
+	on.Ext = filepath.Ext(on.FileName)
+	return on
+}
+
+// parseNameTemplate parses the --name-template. Besides the built-in functions,
+// it has date: {{.Timestamp|date "2006/01/02"}}.
+func parseNameTemplate(text string) (*template.Template, error) {
+	return template.New("name").Option("missingkey=zero").Funcs(template.FuncMap{
+		"date": func(layout string, t time.Time) string { return t.Format(layout) },
+	}).Parse(text)
+}
+
+// outputPath returns the path of the file for the message under dir, named by tmpl.
+// The result of the template is sanitized: absolute paths become relative,
+// and the empty, . and .. elements are dropped.
+func outputPath(dir string, tmpl *template.Template, on outputName) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, on); err != nil {
+		return "", errgo.Notef(err, "name template")
+	}
+	rel := sanitizePath(buf.String())
+	if rel == "" {
+		return "", errgo.Newf("name template gives an empty name (%q)", buf.String())
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+// sanitizeName returns the last element of the path name,
+// without control characters, or empty if nothing usable remains.
+func sanitizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	// both separators, as the sender may be Windows
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	if name = strings.TrimSpace(name); name == "." || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// sanitizePath returns the slash-separated path p as a relative path,
+// with every element sanitized, and the empty, . and .. elements dropped.
+func sanitizePath(p string) string {
+	parts := strings.Split(p, "/")
+	clean := parts[:0]
+	for _, part := range parts {
+		if part = sanitizeName(part); part != "" {
+			clean = append(clean, part)
+		}
+	}
+	return filepath.Join(clean...)
+}
+
+// writeNoClobber writes the content of r into fn atomically: into a temp file
+// in the same directory first, then renamed to fn, or if that exists,
+// to fn with a -N suffix (see uniqueName).
+//
+// Returns the name of the written file.
+func writeNoClobber(fn string, r io.Reader) (string, error) {
+	dir := filepath.Dir(fn)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	fh, err := ioutil.TempFile(dir, "."+filepath.Base(fn)+"-")
+	if err != nil {
+		return "", err
+	}
+	tmp := fh.Name()
+	_, err = io.Copy(fh, r)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	// link fails if the name exists, so concurrent workers can't overwrite each other's files
+	ext := filepath.Ext(fn)
+	base := strings.TrimSuffix(fn, ext)
+	for i, cand := 0, fn; ; i++ {
+		if i > 0 {
+			cand = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		err := os.Link(tmp, cand)
+		if err == nil {
+			os.Remove(tmp)
+			return cand, nil
+		}
+		if os.IsExist(err) {
+			continue
+		}
+		// no hard links on this file system
+		cand = uniqueName(fn)
+		if err := os.Rename(tmp, cand); err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+		return cand, nil
+	}
+}
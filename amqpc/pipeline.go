@@ -0,0 +1,430 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+// Handler processes the artifacts of a message, e.g. a stage of a pipeline.
+type Handler interface {
+	// Handle processes msg.Artifacts, and returns the resulting ones.
+	// No artifact means there's nothing more to do (e.g. an empty page is dropped).
+	Handle(ctx context.Context, msg *Message) ([]Artifact, error)
+}
+
+// HandlerFunc is a function as a Handler.
+type HandlerFunc func(ctx context.Context, msg *Message) ([]Artifact, error)
+
+// Handle calls f.
+func (f HandlerFunc) Handle(ctx context.Context, msg *Message) ([]Artifact, error) {
+	return f(ctx, msg)
+}
+
+// Message is what a Handler gets: the received message, and the artifacts of the previous stage.
+type Message struct {
+	amqp.Delivery
+	// Path is the received file, or the directory of a batch.
+	Path string
+	// Dir is the working directory, for the new artifacts.
+	// It is removed after the pipeline, so keep the results with a store stage.
+	Dir string
+	// Env is the environment of the external commands.
+	Env []string
+	// Limits restrict the external commands.
+	Limits handlerLimits
+	// Stdout and Stderr get the output of the external commands.
+	Stdout, Stderr io.Writer
+	// Artifacts are the input of the Handler.
+	Artifacts []Artifact
+}
+
+// Artifact is a file produced by a stage.
+type Artifact struct {
+	Path        string
+	ContentType string
+}
+
+// Printf writes a line about the processing to the Stdout of the message.
+func (msg *Message) Printf(format string, args ...interface{}) {
+	fmt.Fprintf(msg.Stdout, format+"\n", args...)
+}
+
+// stageType makes a stage from its argument: the text between the parentheses after its name.
+type stageType struct {
+	Usage string
+	New   func(arg string) (Handler, error)
+}
+
+var stageTypes = make(map[string]stageType)
+
+// registerStage registers a stage type under name, for the pipelines.
+func registerStage(name, usage string, newStage func(arg string) (Handler, error)) {
+	if _, ok := stageTypes[name]; ok {
+		panic("stage " + name + " is registered twice")
+	}
+	stageTypes[name] = stageType{Usage: usage, New: newStage}
+}
+
+// stagesUsage returns the usage of the registered stage types, a line each.
+func stagesUsage() string {
+	names := make([]string, 0, len(stageTypes))
+	for name := range stageTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = "  " + stageTypes[name].Usage
+	}
+	return strings.Join(lines, "\n")
+}
+
+func init() {
+	registerStage("each-page", "each-page(PIPELINE): run the pipeline for each artifact on its own", newEachPageStage)
+	registerStage("exec", "exec(CMD ARGS...): run the command for each artifact; {in} is its path, {out} or {out.EXT} the path of the result (else the artifact is passed on), {dir} the working directory", newExecStage)
+	registerStage("filter", "filter(CMD ARGS...): run the command for each artifact ({in} is its path), keep it on exit code 0, drop it on 1", newFilterStage)
+}
+
+// pipeline is a series of stages, each getting the artifacts of the previous one.
+type pipeline struct {
+	Spec   string
+	Names  []string
+	Stages []Handler
+}
+
+// parsePipeline parses a pipeline spec, e.g. "sniff(image/* application/zip) -> unzip -> each-page(exec(optimize2bw -i {in} -o {out.png})) -> assemble-pdf -> store(/srv/scans)".
+func parsePipeline(spec string) (*pipeline, error) {
+	parts, err := splitTop(spec, "->")
+	if err != nil {
+		return nil, err
+	}
+	p := &pipeline{Spec: spec}
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		name, arg := part, ""
+		if i := strings.IndexByte(part, '('); i >= 0 {
+			if !strings.HasSuffix(part, ")") {
+				return nil, errgo.Newf("%q: missing ) at the end", part)
+			}
+			name, arg = strings.TrimSpace(part[:i]), part[i+1:len(part)-1]
+		}
+		st, ok := stageTypes[name]
+		if !ok {
+			return nil, errgo.Newf("unknown stage %q, the known ones:\n%s", name, stagesUsage())
+		}
+		h, err := st.New(arg)
+		if err != nil {
+			return nil, errgo.Notef(err, "stage %q", part)
+		}
+		p.Names = append(p.Names, name)
+		p.Stages = append(p.Stages, h)
+	}
+	return p, nil
+}
+
+// splitTop splits s at sep, outside of the parentheses and quotes.
+func splitTop(s, sep string) ([]string, error) {
+	var parts []string
+	var depth int
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth--; depth < 0 {
+				return nil, errgo.Newf("%q: unbalanced ) at %d", s, i)
+			}
+		case depth == 0 && strings.HasPrefix(s[i:], sep):
+			parts = append(parts, s[start:i])
+			start = i + len(sep)
+			i += len(sep) - 1
+		}
+	}
+	if depth != 0 || quote != 0 {
+		return nil, errgo.Newf("%q: unbalanced parentheses or quotes", s)
+	}
+	parts = append(parts, s[start:])
+	for _, part := range parts {
+		if strings.TrimSpace(part) == "" {
+			return nil, errgo.Newf("%q: empty stage", s)
+		}
+	}
+	return parts, nil
+}
+
+// splitWords splits s into words at the spaces, except in '...' and "...".
+func splitWords(s string) ([]string, error) {
+	var words []string
+	var word []byte
+	var inWord bool
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word = append(word, c)
+			}
+		case c == '\'' || c == '"':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, string(word))
+				word, inWord = word[:0], false
+			}
+		default:
+			word, inWord = append(word, c), true
+		}
+	}
+	if quote != 0 {
+		return nil, errgo.Newf("%q: unbalanced quotes", s)
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words, nil
+}
+
+// Handle runs the stages one after the other, till the last one, or one without artifacts.
+func (p *pipeline) Handle(ctx context.Context, msg *Message) ([]Artifact, error) {
+	arts := msg.Artifacts
+	for i, h := range p.Stages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		m := *msg
+		m.Artifacts = arts
+		var err error
+		if arts, err = h.Handle(ctx, &m); err != nil {
+			return nil, errgo.Notef(err, "stage %d (%s)", i+1, p.Names[i])
+		}
+		msg.Printf("# %s: %d artifacts", p.Names[i], len(arts))
+		if len(arts) == 0 {
+			break
+		}
+	}
+	return arts, nil
+}
+
+func newEachPageStage(arg string) (Handler, error) {
+	p, err := parsePipeline(arg)
+	if err != nil {
+		return nil, err
+	}
+	return HandlerFunc(func(ctx context.Context, msg *Message) ([]Artifact, error) {
+		var arts []Artifact
+		for _, a := range msg.Artifacts {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			m := *msg
+			m.Artifacts = []Artifact{a}
+			res, err := p.Handle(ctx, &m)
+			if err != nil {
+				return nil, errgo.Notef(err, "%q", a.Path)
+			}
+			arts = append(arts, res...)
+		}
+		return arts, nil
+	}), nil
+}
+
+// commandStage runs an external command for each artifact.
+type commandStage struct {
+	Args []string
+	// Filter says whether the exit code decides about keeping the artifact.
+	Filter bool
+}
+
+func newExecStage(arg string) (Handler, error) {
+	args, err := splitWords(arg)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errgo.New("no command")
+	}
+	return commandStage{Args: args}, nil
+}
+
+func newFilterStage(arg string) (Handler, error) {
+	h, err := newExecStage(arg)
+	if err != nil {
+		return nil, err
+	}
+	cs := h.(commandStage)
+	cs.Filter = true
+	return cs, nil
+}
+
+// Handle runs the command for each artifact.
+func (cs commandStage) Handle(ctx context.Context, msg *Message) ([]Artifact, error) {
+	var arts []Artifact
+	for i, a := range msg.Artifacts {
+		// the command gets only the time left of the handler's
+		lim, err := msg.Limits.within(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var out string
+		args := make([]string, len(cs.Args))
+		for j, s := range cs.Args {
+			args[j] = expandPlaceholders(s, a.Path, msg.Dir, i, &out)
+		}
+		if out != "" {
+			// the command creates it
+			os.Remove(out)
+		}
+		cmd, err := lim.Command(args)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Env = append(os.Environ(), msg.Env...)
+		cmd.Env = append(cmd.Env, "AMQP_ARTIFACT="+a.Path, "AMQP_ARTIFACT_CONTENT_TYPE="+a.ContentType)
+		cmd.Stdout, cmd.Stderr = msg.Stdout, msg.Stderr
+		msg.Printf("# %q", args)
+		err = lim.Run(cmd)
+		if cs.Filter {
+			if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 1 {
+				msg.Printf("# dropped %q", a.Path)
+				continue
+			}
+		}
+		if err != nil {
+			return nil, errgo.Notef(err, "%q", args)
+		}
+		if out == "" {
+			arts = append(arts, a)
+			continue
+		}
+		if _, err := os.Stat(out); err != nil {
+			if os.IsNotExist(err) {
+				msg.Printf("# no %q, dropped %q", out, a.Path)
+				continue
+			}
+			return nil, err
+		}
+		arts = append(arts, Artifact{Path: out, ContentType: mime.TypeByExtension(filepath.Ext(out))})
+	}
+	return arts, nil
+}
+
+// expandPlaceholders replaces {in}, {dir}, {out} and {out.EXT} in s;
+// out is set to the path of the result if s refers to it.
+//
+// The result is in dir, named after in, with the index i of the artifact,
+// and EXT or the extension of in.
+func expandPlaceholders(s, in, dir string, i int, out *string) string {
+	s = strings.Replace(s, "{in}", in, -1)
+	s = strings.Replace(s, "{dir}", dir, -1)
+	for {
+		j := strings.Index(s, "{out")
+		if j < 0 {
+			return s
+		}
+		k := strings.IndexByte(s[j:], '}')
+		if k < 0 {
+			return s
+		}
+		ext := filepath.Ext(in)
+		if spec := s[j+4 : j+k]; strings.HasPrefix(spec, ".") {
+			ext = spec
+		} else if spec != "" {
+			return s
+		}
+		base := strings.TrimSuffix(filepath.Base(in), filepath.Ext(in))
+		*out = filepath.Join(dir, fmt.Sprintf("%s-%03d%s", base, i, ext))
+		if _, err := os.Stat(*out); err == nil || *out == in {
+			*out = filepath.Join(dir, fmt.Sprintf("%s-%03d-%d%s", base, i, time.Now().UnixNano(), ext))
+		}
+		s = s[:j] + *out + s[j+k+1:]
+	}
+}
+
+// runPipeline runs the pipeline on fn (the received file, or the directory of a batch),
+// in a working directory next to it.
+// The paths of the final artifacts are written to stdout, as ARTIFACT=path lines.
+func (rc receiver) runPipeline(fn string, env []string, msg amqp.Delivery, stdout, stderr io.Writer) error {
+	dir, err := ioutil.TempDir(filepath.Dir(fn), ".pipeline-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	m := &Message{
+		Delivery: msg, Path: fn, Dir: dir,
+		Env: env, Limits: rc.Limits,
+		Stdout: stdout, Stderr: stderr,
+	}
+	if fi, err := os.Stat(fn); err != nil {
+		return err
+	} else if fi.IsDir() {
+		fis, err := ioutil.ReadDir(fn)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			if fi.Mode().IsRegular() && !strings.HasPrefix(fi.Name(), ".") {
+				p := filepath.Join(fn, fi.Name())
+				m.Artifacts = append(m.Artifacts, Artifact{Path: p, ContentType: mime.TypeByExtension(filepath.Ext(p))})
+			}
+		}
+	} else {
+		m.Artifacts = []Artifact{{Path: fn, ContentType: msg.ContentType}}
+	}
+
+	ctx := context.Background()
+	if rc.Limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rc.Limits.Timeout)
+		defer cancel()
+	}
+	arts, err := rc.Pipeline.Handle(ctx, m)
+	if err != nil {
+		return err
+	}
+	for _, a := range arts {
+		m.Printf("ARTIFACT=%s", a.Path)
+	}
+	log.Printf("%q: %d artifacts of %q.", rc.Pipeline.Spec, len(arts), fn)
+	return nil
+}
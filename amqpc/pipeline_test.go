@@ -0,0 +1,469 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestSplitTop(t *testing.T) {
+	for i, tc := range []struct {
+		in   string
+		want []string
+		err  bool
+	}{
+		{in: "a", want: []string{"a"}},
+		{in: "a -> b", want: []string{"a ", " b"}},
+		{in: "a(x -> y) -> b", want: []string{"a(x -> y) ", " b"}},
+		{in: "a(f(x) -> g(y))->b", want: []string{"a(f(x) -> g(y))", "b"}},
+		{in: "exec(sh -c 'x -> y') -> b", want: []string{"exec(sh -c 'x -> y') ", " b"}},
+		{in: `exec(echo ")") -> b`, want: []string{`exec(echo ")") `, " b"}},
+		{in: "a -> ", err: true},
+		{in: "-> b", err: true},
+		{in: "a(b", err: true},
+		{in: "a) -> (b", err: true},
+		{in: "a('b) -> c", err: true},
+	} {
+		got, err := splitTop(tc.in, "->")
+		if tc.err {
+			if err == nil {
+				t.Errorf("%d. %q: no error, got %q", i, tc.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. %q: %v", i, tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%d. %q: got %q, wanted %q", i, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	for i, tc := range []struct {
+		in   string
+		want []string
+		err  bool
+	}{
+		{in: "", want: nil},
+		{in: "  a  b\tc\n", want: []string{"a", "b", "c"}},
+		{in: `sh -c 'echo "$1"' - {in}`, want: []string{"sh", "-c", `echo "$1"`, "-", "{in}"}},
+		{in: `a"b c"d`, want: []string{"ab cd"}},
+		{in: `'' x`, want: []string{"", "x"}},
+		{in: "'a", err: true},
+		{in: `a "b`, err: true},
+	} {
+		got, err := splitWords(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%d. %q: no error, got %q", i, tc.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. %q: %v", i, tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%d. %q: got %q, wanted %q", i, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParsePipeline(t *testing.T) {
+	for i, tc := range []struct {
+		spec  string
+		names []string
+		err   string
+	}{
+		{spec: "unzip", names: []string{"unzip"}},
+		{spec: "sniff(image/* application/zip) -> unzip -> each-page(exec(unpaper {in} {out})) -> assemble-pdf -> store(/srv/scans)",
+			names: []string{"sniff", "unzip", "each-page", "assemble-pdf", "store"}},
+		{spec: " filter( test -s {in} ) -> assemble-pdf(150)", names: []string{"filter", "assemble-pdf"}},
+		{spec: "sniff -> nope", err: "unknown stage"},
+		{spec: "each-page(sniff", err: "unbalanced"},
+		{spec: "sniff(image/*) x", err: "missing )"},
+		{spec: "unzip(x)", err: "no argument"},
+		{spec: "store", err: "needs a DIR"},
+		{spec: "sniff([)", err: "pattern"},
+		{spec: "assemble-pdf(many)", err: "assemble-pdf"},
+		{spec: "exec()", err: "exec"},
+		{spec: "each-page(nope)", err: "unknown stage"},
+	} {
+		p, err := parsePipeline(tc.spec)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%d. %q: got %v, wanted error with %q", i, tc.spec, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. %q: %v", i, tc.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(p.Names, tc.names) || len(p.Stages) != len(tc.names) {
+			t.Errorf("%d. %q: got %q (%d stages), wanted %q", i, tc.spec, p.Names, len(p.Stages), tc.names)
+		}
+	}
+}
+
+func TestExpandPlaceholders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amqpc-expand-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "scan.pnm")
+	taken := filepath.Join(dir, "taken-002.png")
+	if err := ioutil.WriteFile(taken, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		s, in   string
+		i       int
+		want    string
+		wantOut string
+	}{
+		{s: "cat {in}", in: in, want: "cat " + in},
+		{s: "ls {dir}", in: in, want: "ls " + dir},
+		{s: "cp {in} {out}", in: in, i: 1,
+			want: "cp " + in + " " + filepath.Join(dir, "scan-001.pnm"), wantOut: filepath.Join(dir, "scan-001.pnm")},
+		{s: "convert {in} {out.png}", in: in, i: 12,
+			want: "convert " + in + " " + filepath.Join(dir, "scan-012.png"), wantOut: filepath.Join(dir, "scan-012.png")},
+		{s: "x {out.tar.gz}", in: in,
+			want: "x " + filepath.Join(dir, "scan-000.tar.gz"), wantOut: filepath.Join(dir, "scan-000.tar.gz")},
+		{s: "{outer} {out", in: in, want: "{outer} {out"},
+	} {
+		var out string
+		got := expandPlaceholders(tc.s, tc.in, dir, tc.i, &out)
+		if got != tc.want || out != tc.wantOut {
+			t.Errorf("%d. %q: got %q (out=%q), wanted %q (out=%q)", i, tc.s, got, out, tc.want, tc.wantOut)
+		}
+	}
+
+	// an existing file is not overwritten
+	var out string
+	expandPlaceholders("{out.png}", filepath.Join(dir, "taken.pnm"), dir, 2, &out)
+	if out == taken || filepath.Dir(out) != dir || filepath.Ext(out) != ".png" {
+		t.Errorf("got %q for the taken %q", out, taken)
+	}
+}
+
+// writeZip writes a zip archive into fn with the named files (their content is their name).
+func writeZip(t *testing.T, fn string, names ...string) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(name, "/") {
+			w.Write([]byte(name))
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnzipFlat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amqpc-unzip-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "in.zip")
+	writeZip(t, fn, "scan/p2.png", "scan/", "p1.png", "../../evil/p3.png", `win\p0.png`, "/abs/p4.png", "a/..")
+	out := filepath.Join(dir, "out")
+	if err := os.Mkdir(out, 0700); err != nil {
+		t.Fatal(err)
+	}
+	files, err := unzipFlat(context.Background(), fn, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		if filepath.Dir(f) != out {
+			t.Errorf("%q is outside of %q", f, out)
+		}
+		names = append(names, filepath.Base(f))
+	}
+	if want := []string{"p0.png", "p1.png", "p2.png", "p3.png", "p4.png"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %q, wanted %q", names, want)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(out, "p3.png")); err != nil || string(b) != "../../evil/p3.png" {
+		t.Errorf("p3.png: %q, %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "..", "evil")); err == nil {
+		t.Error("evil is written outside")
+	}
+
+	// a name clash doesn't overwrite
+	files, err = unzipFlat(context.Background(), fn, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if b, err := ioutil.ReadFile(f); err != nil || sanitizeName(string(b)) != strings.Replace(filepath.Base(f), "-1.", ".", 1) {
+			t.Errorf("%q: %q, %v", f, b, err)
+		}
+	}
+	if fis, _ := ioutil.ReadDir(out); len(fis) != 10 {
+		t.Errorf("got %d files, wanted 10", len(fis))
+	}
+}
+
+func TestUnzipStage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amqpc-unzip-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	zipFn, txtFn := filepath.Join(dir, "in.bin"), filepath.Join(dir, "in.txt")
+	writeZip(t, zipFn, "b.txt", "a.txt")
+	if err := ioutil.WriteFile(txtFn, []byte("PK"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := newUnzipStage("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		in   Artifact
+		want []string
+	}{
+		{in: Artifact{Path: zipFn, ContentType: "application/zip"}, want: []string{"a.txt", "b.txt"}},
+		// without sniff before unzip, or with a wrong type
+		{in: Artifact{Path: zipFn}, want: []string{"a.txt", "b.txt"}},
+		{in: Artifact{Path: zipFn, ContentType: "application/octet-stream"}, want: []string{"a.txt", "b.txt"}},
+		{in: Artifact{Path: txtFn}, want: []string{"in.txt"}},
+		{in: Artifact{Path: txtFn, ContentType: "text/plain"}, want: []string{"in.txt"}},
+	} {
+		out, err := ioutil.TempDir(dir, "out-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		arts, err := h.Handle(context.Background(), &Message{Dir: out, Artifacts: []Artifact{tc.in}})
+		if err != nil {
+			t.Errorf("%d. %+v: %v", i, tc.in, err)
+			continue
+		}
+		var names []string
+		for _, a := range arts {
+			names = append(names, filepath.Base(a.Path))
+		}
+		if !reflect.DeepEqual(names, tc.want) {
+			t.Errorf("%d. %+v: got %q, wanted %q", i, tc.in, names, tc.want)
+		}
+	}
+}
+
+func TestWritePDF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amqpc-pdf-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gray := image.NewGray(image.Rect(0, 0, 30, 20))
+	rgb := image.NewRGBA(image.Rect(0, 0, 10, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 10; x++ {
+			rgb.Set(x, y, color.RGBA{R: uint8(x * 20), G: uint8(y), B: 7, A: 255})
+		}
+	}
+	grayRGB := image.NewRGBA(image.Rect(0, 0, 5, 5)) // gray pixels in an RGB image
+	var images []Artifact
+	for i, img := range []image.Image{gray, rgb, grayRGB} {
+		fn := filepath.Join(dir, strconv.Itoa(i)+".png")
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, buf.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, Artifact{Path: fn, ContentType: "image/png"})
+	}
+
+	var buf bytes.Buffer
+	if err := writePDF(context.Background(), &buf, images, 150); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	if !bytes.HasPrefix(b, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(b, []byte("%%EOF\n")) {
+		t.Fatalf("bad header or trailer:\n%q", b)
+	}
+
+	// the xref table points to the objects
+	m := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(b)
+	if m == nil {
+		t.Fatal("no startxref")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(b[xref:], []byte("xref\n0 12\n0000000000 65535 f \n")) {
+		t.Fatalf("no xref at %d: %q", xref, b[xref:])
+	}
+	entries := b[xref+len("xref\n0 12\n0000000000 65535 f \n"):]
+	for i := 1; i < 12; i++ {
+		off, err := strconv.Atoi(string(entries[:10]))
+		if err != nil || !bytes.HasPrefix(b[off:], []byte(strconv.Itoa(i)+" 0 obj\n")) {
+			t.Errorf("object %d is not at %q", i, entries[:20])
+		}
+		entries = entries[20:]
+	}
+	if !bytes.Contains(b, []byte("/Type /Pages /Kids [3 0 R 6 0 R 9 0 R] /Count 3")) {
+		t.Error("bad page tree")
+	}
+	// 30x20 pixels at 150 DPI
+	if !bytes.Contains(b, []byte("/MediaBox [0 0 14.40 9.60]")) {
+		t.Error("bad MediaBox of the first page")
+	}
+
+	// the streams are as long as their /Length, and the images inflate to their samples
+	streams := regexp.MustCompile(`<<([^>]*) /Length (\d+)>>\nstream\n`).FindAllSubmatchIndex(b, -1)
+	if len(streams) != 6 {
+		t.Fatalf("got %d streams, wanted 6", len(streams))
+	}
+	wantImages := []struct {
+		colorSpace    string
+		width, height int
+		components    int
+	}{{"DeviceGray", 30, 20, 1}, {"DeviceRGB", 10, 40, 3}, {"DeviceGray", 5, 5, 1}}
+	for i, loc := range streams {
+		dict := string(b[loc[2]:loc[3]])
+		length, _ := strconv.Atoi(string(b[loc[4]:loc[5]]))
+		data := b[loc[1] : loc[1]+length]
+		if !bytes.HasPrefix(b[loc[1]+length:], []byte("\nendstream\nendobj\n")) {
+			t.Errorf("stream %d: no endstream after %d bytes", i, length)
+			continue
+		}
+		if i%2 == 0 {
+			continue // the contents of a page
+		}
+		want := wantImages[i/2]
+		if !strings.Contains(dict, "/Width "+strconv.Itoa(want.width)+" /Height "+strconv.Itoa(want.height)+" /ColorSpace /"+want.colorSpace) {
+			t.Errorf("image %d: %q, wanted %+v", i/2, dict, want)
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("image %d: %v", i/2, err)
+			continue
+		}
+		samples, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Errorf("image %d: %v", i/2, err)
+		}
+		if len(samples) != want.width*want.height*want.components {
+			t.Errorf("image %d: got %d samples, wanted %d", i/2, len(samples), want.width*want.height*want.components)
+		}
+	}
+}
+
+func TestRunPipeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amqpc-pipeline-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var zbuf bytes.Buffer
+	zw := zip.NewWriter(&zbuf)
+	for i, name := range []string{"scan/p2.png", "scan/p1.png"} {
+		w, _ := zw.Create(name)
+		png.Encode(w, image.NewGray(image.Rect(0, 0, 10*(i+1), 10)))
+	}
+	zw.Close()
+	fn := filepath.Join(dir, "in.zip")
+	if err := ioutil.WriteFile(fn, zbuf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store := filepath.Join(dir, "store")
+
+	p, err := parsePipeline(`unzip -> each-page(exec(cp {in} {out.png})) -> assemble-pdf -> exec(sh -c 'echo "$AMQP_MESSAGE_ID $1"' - {in}) -> store(` + store + `)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := amqp.Delivery{MessageId: "mid"}
+	res, err := receiver{Pipeline: p}.Run(fn, messageEnv(msg), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(res.Stdout), "ARTIFACT="+filepath.Join(store, "in.pdf")) || !strings.Contains(string(res.Stdout), "mid ") {
+		t.Errorf("stdout: %q", res.Stdout)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(store, "in.pdf")); err != nil || bytes.Count(b, []byte("/Type /Page ")) != 2 {
+		t.Errorf("in.pdf: %d bytes, %v", len(b), err)
+	}
+	fis, _ := ioutil.ReadDir(dir)
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), ".pipeline-") {
+			t.Errorf("%q is left", fi.Name())
+		}
+	}
+
+	p, err = parsePipeline("exec(false)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = (receiver{Pipeline: p}).Run(fn, nil, amqp.Delivery{}); err == nil {
+		t.Error("no error for a failing command")
+	}
+}
+
+func TestPipelineTimeout(t *testing.T) {
+	fh, err := ioutil.TempFile("", "amqpc-timeout-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	defer os.Remove(fh.Name())
+	p, err := parsePipeline("exec(sleep 1) -> exec(sleep 5)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second command must get only the 0.5s left, not the whole timeout
+	rc := receiver{Pipeline: p, Limits: handlerLimits{Timeout: 1500 * time.Millisecond, Grace: 100 * time.Millisecond}}
+	start := time.Now()
+	if _, err = rc.Run(fh.Name(), nil, amqp.Delivery{}); err == nil {
+		t.Error("no error for a timed out pipeline")
+	}
+	if d := time.Since(start); d > 2300*time.Millisecond {
+		t.Errorf("the pipeline ran for %s, with a timeout of %s", d, rc.Limits.Timeout)
+	}
+}
@@ -0,0 +1,407 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+// maxInFlight is the maximal number of unconfirmed messages held in memory.
+const maxInFlight = 4
+
+// retryBackoff is the delay before republishing a NACKed or returned message,
+// multiplied by the number of attempts.
+const retryBackoff = time.Second
+
+// publisher publishes messages with publisher confirms,
+// and puts the ones the broker couldn't take into the spool.
+//
+// When the connection breaks, the publisher goes offline,
+// and spools every subsequent message.
+//
+// The NACKed and returned (unroutable mandatory) messages are republished
+// at most Retries times; then the NACKed ones are spooled, the returned ones fail.
+// The outcome is tracked per item (see Begin and Results).
+type publisher struct {
+	Retries int
+
+	client   *amqpClient
+	spool    spool
+	timeout  time.Duration
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+
+	seq        uint64
+	pending    map[uint64]pendingMessage
+	retries    []pendingMessage
+	returned   map[returnKey]int
+	offlineErr error
+	spoolErr   error
+
+	item    string
+	items   []string
+	results map[string]*itemResult
+
+	Delivered, Spooled int
+}
+
+type pendingMessage struct {
+	// name in the spool, if it has been spooled already.
+	name string
+	// item is what the message is (a part of).
+	item     string
+	attempts int
+	// retryAt is the time of the next attempt.
+	retryAt time.Time
+	spooledMessage
+}
+
+// returnKey identifies a message (or a chunk of it) in a Return.
+type returnKey struct {
+	MessageID, TransferID string
+	Chunk                 int64
+}
+
+func returnKeyOf(messageID string, headers amqp.Table) returnKey {
+	k := returnKey{MessageID: messageID, TransferID: headerString(headers[hdrTransferID])}
+	k.Chunk, _ = headerInt(headers[hdrChunkIndex])
+	return k
+}
+
+// itemResult is the outcome of publishing an item (e.g. a file), which may be sent in several messages.
+type itemResult struct {
+	Item                                           string
+	Messages, Delivered, Spooled, Returned, Nacked int
+	// Retried is the number of republishings.
+	Retried int
+	Err     error
+}
+
+// Status returns "delivered" if all the messages of the item are confirmed by the broker,
+// "spooled" if some are spooled instead, else "failed".
+func (r itemResult) Status() string {
+	switch {
+	case r.Err != nil || r.Returned != 0 || r.Delivered+r.Spooled < r.Messages:
+		return "failed"
+	case r.Spooled != 0:
+		return "spooled"
+	}
+	return "delivered"
+}
+
+// newPublisher returns a publisher over c, which may be nil for an offline publisher.
+func newPublisher(c *amqpClient, sp spool, timeout time.Duration) (*publisher, error) {
+	p := &publisher{
+		spool: sp, timeout: timeout,
+		pending:  make(map[uint64]pendingMessage),
+		returned: make(map[returnKey]int),
+		results:  make(map[string]*itemResult),
+	}
+	if c == nil {
+		p.offlineErr = errgo.New("no connection")
+		return p, nil
+	}
+	if err := c.Confirm(false); err != nil {
+		return nil, errgo.Notef(err, "Confirm")
+	}
+	p.client = c
+	p.confirms = c.NotifyPublish(make(chan amqp.Confirmation, maxInFlight))
+	p.returns = c.NotifyReturn(make(chan amqp.Return, 1))
+	return p, nil
+}
+
+// Offline returns the reason for being offline, or nil.
+func (p *publisher) Offline() error { return p.offlineErr }
+
+// Begin starts a new item: the subsequently published messages belong to it.
+func (p *publisher) Begin(item string) {
+	p.item = item
+	if _, ok := p.results[item]; !ok {
+		p.items = append(p.items, item)
+		p.results[item] = &itemResult{Item: item}
+	}
+}
+
+// Fail marks the item as failed with err.
+func (p *publisher) Fail(item string, err error) {
+	if r := p.results[item]; r != nil && r.Err == nil {
+		r.Err = err
+	}
+}
+
+// Results returns the outcome of the items, in the order of Begin.
+// Call it after Flush.
+func (p *publisher) Results() []itemResult {
+	rs := make([]itemResult, len(p.items))
+	for i, item := range p.items {
+		rs[i] = *p.results[item]
+	}
+	return rs
+}
+
+// Take returns the outcome of the item, and forgets it.
+// Call it after Flush.
+func (p *publisher) Take(item string) itemResult {
+	r := p.results[item]
+	if r == nil {
+		return itemResult{Item: item}
+	}
+	delete(p.results, item)
+	for i, it := range p.items {
+		if it == item {
+			p.items = append(p.items[:i], p.items[i+1:]...)
+			break
+		}
+	}
+	return *r
+}
+
+// result returns the result of the item, or nil if it's not tracked.
+func (p *publisher) result(item string) *itemResult {
+	if item == "" {
+		return nil
+	}
+	return p.results[item]
+}
+
+// Publish the message, or spool it if the broker is unreachable.
+//
+// name is the message's name in the spool, if it has been spooled already.
+func (p *publisher) Publish(name string, msg spooledMessage) error {
+	if r := p.result(p.item); r != nil {
+		r.Messages++
+	}
+	return p.publish(pendingMessage{name: name, item: p.item, spooledMessage: msg})
+}
+
+func (p *publisher) publish(pm pendingMessage) error {
+	for p.client != nil && len(p.pending) >= maxInFlight {
+		if err := p.waitOne(); err != nil {
+			p.goOffline(err)
+		}
+	}
+	if p.client != nil {
+		err := p.client.Publish(pm.Exchange, pm.Key, pm.Mandatory, false, pm.Publishing)
+		if err == nil {
+			p.seq++
+			p.pending[p.seq] = pm
+			return nil
+		}
+		p.goOffline(errgo.Notef(err, "Publish"))
+	}
+	return p.toSpool(pm)
+}
+
+// Flush waits for the confirmation of the pending messages, republishes the ones to be retried,
+// and spools the unconfirmed ones.
+//
+// Returns error if some message could be neither delivered, nor spooled.
+func (p *publisher) Flush() error {
+	for p.client != nil {
+		if len(p.retries) != 0 {
+			pm := p.retries[0]
+			p.retries = p.retries[1:]
+			time.Sleep(time.Until(pm.retryAt))
+			p.publish(pm)
+			continue
+		}
+		if len(p.pending) == 0 {
+			break
+		}
+		if err := p.waitOne(); err != nil {
+			p.goOffline(err)
+		}
+	}
+	return p.spoolErr
+}
+
+// Close flushes the publisher, and closes the underlying client.
+func (p *publisher) Close() error {
+	p.Flush()
+	if p.client != nil {
+		p.client.Close()
+		p.client = nil
+	}
+	return p.spoolErr
+}
+
+// waitOne waits for one confirmation.
+func (p *publisher) waitOne() error {
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case c, ok := <-p.confirms:
+			if !ok {
+				return errgo.New("channel closed")
+			}
+			// the return of a message comes before its confirmation
+			p.drainReturns()
+			pm, ok := p.pending[c.DeliveryTag]
+			if !ok {
+				log.Printf("Unknown delivery tag %d.", c.DeliveryTag)
+				continue
+			}
+			delete(p.pending, c.DeliveryTag)
+			p.settle(c.DeliveryTag, pm, c.Ack)
+			return nil
+		case r, ok := <-p.returns:
+			if !ok {
+				return errgo.New("channel closed")
+			}
+			p.noteReturn(r)
+		case <-timer.C:
+			return errgo.Newf("no confirmation in %s", p.timeout)
+		}
+	}
+}
+
+func (p *publisher) drainReturns() {
+	for {
+		select {
+		case r, ok := <-p.returns:
+			if !ok {
+				return
+			}
+			p.noteReturn(r)
+		default:
+			return
+		}
+	}
+}
+
+func (p *publisher) noteReturn(r amqp.Return) {
+	log.Printf("%q is returned by %q/%q: %d %s", r.MessageId, r.Exchange, r.RoutingKey, r.ReplyCode, r.ReplyText)
+	p.returned[returnKeyOf(r.MessageId, r.Headers)]++
+}
+
+// settle the confirmed message: it's delivered, to be retried, spooled or failed.
+func (p *publisher) settle(tag uint64, pm pendingMessage, ack bool) {
+	r := p.result(pm.item)
+	key := returnKeyOf(pm.MessageId, pm.Headers)
+	returned := p.returned[key] > 0
+	if returned {
+		if p.returned[key]--; p.returned[key] == 0 {
+			delete(p.returned, key)
+		}
+	}
+	if ack && !returned {
+		log.Printf("Delivered %d.", tag)
+		p.Delivered++
+		if r != nil {
+			r.Delivered++
+		}
+		if pm.name != "" {
+			if err := p.spool.Remove(pm.name); err != nil {
+				log.Printf("Remove %q from spool: %v", pm.name, err)
+			}
+		}
+		return
+	}
+	if pm.attempts < p.Retries {
+		pm.attempts++
+		pm.retryAt = time.Now().Add(time.Duration(pm.attempts) * retryBackoff)
+		if r != nil {
+			r.Retried++
+		}
+		log.Printf("couldn't deliver %d (returned: %t), retrying (%d of %d).", tag, returned, pm.attempts, p.Retries)
+		p.retries = append(p.retries, pm)
+		return
+	}
+	if returned {
+		log.Printf("%q is unroutable.", pm.item)
+		if r != nil {
+			r.Returned++
+		}
+		return
+	}
+	log.Printf("couldn't deliver %d", tag)
+	if r != nil {
+		r.Nacked++
+	}
+	p.toSpool(pm)
+}
+
+// goOffline closes the client, and spools the pending messages.
+func (p *publisher) goOffline(err error) {
+	log.Printf("Broker is unreachable (%v), spooling messages to %q.", err, p.spool.Dir)
+	p.offlineErr = err
+	if p.client != nil {
+		p.client.Close()
+		p.client = nil
+	}
+	tags := make([]uint64, 0, len(p.pending))
+	for tag := range p.pending {
+		tags = append(tags, tag)
+	}
+	// keep the order of publishing
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	for _, tag := range tags {
+		p.toSpool(p.pending[tag])
+	}
+	p.pending = make(map[uint64]pendingMessage)
+	for _, pm := range p.retries {
+		p.toSpool(pm)
+	}
+	p.retries = nil
+}
+
+func (p *publisher) toSpool(pm pendingMessage) error {
+	if pm.name != "" {
+		return nil
+	}
+	r := p.result(pm.item)
+	if _, err := p.spool.Put(pm.spooledMessage); err != nil {
+		err = errgo.Notef(err, "couldn't deliver, nor spool %q", pm.Headers["FileName"])
+		log.Println(err)
+		if p.spoolErr == nil {
+			p.spoolErr = err
+		}
+		if r != nil && r.Err == nil {
+			r.Err = err
+		}
+		return err
+	}
+	p.Spooled++
+	if r != nil {
+		r.Spooled++
+	}
+	return nil
+}
+
+// printResults writes a table of the items' outcomes to w.
+func printResults(w io.Writer, results []itemResult) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ITEM\tMESSAGES\tDELIVERED\tSPOOLED\tRETURNED\tNACKED\tRETRIED\tSTATUS\tERROR")
+	for _, r := range results {
+		var errText string
+		if r.Err != nil {
+			errText = r.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\n",
+			r.Item, r.Messages, r.Delivered, r.Spooled, r.Returned, r.Nacked, r.Retried, r.Status(), errText)
+	}
+	return tw.Flush()
+}
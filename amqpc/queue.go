@@ -0,0 +1,130 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+// queueOptions are the settings of queue declare.
+type queueOptions struct {
+	Durable, AutoDelete bool
+	// MaxLength and MaxLengthBytes limit the queue (x-max-length, x-max-length-bytes),
+	// Overflow says what happens then (x-overflow: drop-head, reject-publish or reject-publish-dlx).
+	MaxLength, MaxLengthBytes int64
+	Overflow                  string
+	// MessageTTL is the x-message-ttl, rounded to milliseconds.
+	MessageTTL time.Duration
+	// DeadLetterExchange and DeadLetterRoutingKey are where the expired,
+	// rejected and dropped messages go; with an empty exchange, DeadLetterRoutingKey
+	// names the queue.
+	DeadLetterExchange, DeadLetterRoutingKey string
+	// Type is the x-queue-type: classic, quorum or stream.
+	Type string
+	// Args are the other arguments, in the form of the pub --header flags.
+	Args []string
+}
+
+// Table returns the arguments of the queue declaration.
+func (o queueOptions) Table() (amqp.Table, error) {
+	tbl, err := parseHeaders(o.Args)
+	if err != nil {
+		return nil, err
+	}
+	if o.MaxLength > 0 {
+		tbl["x-max-length"] = o.MaxLength
+	}
+	if o.MaxLengthBytes > 0 {
+		tbl["x-max-length-bytes"] = o.MaxLengthBytes
+	}
+	switch o.Overflow {
+	case "":
+	case "drop-head", "reject-publish", "reject-publish-dlx":
+		tbl["x-overflow"] = o.Overflow
+	default:
+		return nil, errgo.Newf("unknown overflow behaviour %q (drop-head, reject-publish or reject-publish-dlx)", o.Overflow)
+	}
+	if o.MessageTTL > 0 {
+		tbl["x-message-ttl"] = int64(o.MessageTTL / time.Millisecond)
+	}
+	if o.DeadLetterExchange != "" || o.DeadLetterRoutingKey != "" {
+		tbl["x-dead-letter-exchange"] = o.DeadLetterExchange
+		if o.DeadLetterRoutingKey != "" {
+			tbl["x-dead-letter-routing-key"] = o.DeadLetterRoutingKey
+		}
+	}
+	switch o.Type {
+	case "", "classic":
+	case "quorum", "stream":
+		if !o.Durable || o.AutoDelete {
+			return nil, errgo.Newf("%s queues must be durable, and cannot be auto-deleted", o.Type)
+		}
+	default:
+		return nil, errgo.Newf("unknown queue type %q (classic, quorum or stream)", o.Type)
+	}
+	if o.Type != "" {
+		tbl["x-queue-type"] = o.Type
+	}
+	return tbl, tbl.Validate()
+}
+
+// peekQueue gets at most n messages from the queue, and requeues them,
+// so they stay in the queue in the same order (but marked as redelivered).
+func peekQueue(ch Channel, queue string, n int) ([]amqp.Delivery, error) {
+	var msgs []amqp.Delivery
+	for len(msgs) < n {
+		msg, ok, err := ch.Get(queue, false)
+		if err != nil {
+			return msgs, errgo.Notef(err, "Get(%q)", queue)
+		}
+		if !ok {
+			break
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) != 0 {
+		if err := msgs[len(msgs)-1].Nack(true, true); err != nil {
+			return msgs, errgo.Notef(err, "requeue")
+		}
+	}
+	return msgs, nil
+}
+
+// printMessages writes a table of the messages' properties, sizes and headers to w.
+func printMessages(w io.Writer, msgs []amqp.Delivery) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tMESSAGE ID\tTIMESTAMP\tAPP ID\tCONTENT TYPE\tENCODING\tSIZE\tREDELIVERED\tHEADERS")
+	for i, msg := range msgs {
+		var ts, headers string
+		if !msg.Timestamp.IsZero() {
+			ts = msg.Timestamp.Format(time.RFC3339)
+		}
+		if len(msg.Headers) != 0 {
+			headers = headerString(msg.Headers)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%t\t%s\n",
+			i+1, msg.MessageId, ts, msg.AppId, msg.ContentType, msg.ContentEncoding,
+			len(msg.Body), msg.Redelivered, headers)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,314 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+// Headers of the retried and dead-lettered messages.
+const (
+	hdrAttempts = "Attempts"
+	hdrError    = "Error"
+	hdrExitCode = "ExitCode"
+	hdrStderr   = "Stderr"
+	// hdrOriginalUserID is the user ID of the message, which can't be republished
+	// by an other user.
+	hdrOriginalUserID = "x-original-user-id"
+)
+
+// stderrTailSize is the size of the handler's stderr tail attached to dead letters.
+const stderrTailSize = 4 << 10
+
+// stdoutTailSize is the size of the handler's stdout tail sent in the RPC reply.
+const stdoutTailSize = 64 << 10
+
+// retryPolicy says what happens with a message whose processing failed.
+//
+// The message is republished with an Attempts header through a delay queue,
+// which dead-letters it back to the original queue after its TTL.
+// The delay doubles with each attempt; after MaxAttempts failures
+// the message goes to the dead-letter exchange.
+type retryPolicy struct {
+	MaxAttempts     int
+	Delay, MaxDelay time.Duration
+
+	DeadLetterExchange, DeadLetterQueue string
+}
+
+// delay returns the delay before the given (1-based) attempt.
+func (rp retryPolicy) delay(attempt int) time.Duration {
+	d := rp.Delay
+	for i := 1; i < attempt && d < rp.MaxDelay; i++ {
+		d *= 2
+	}
+	if rp.MaxDelay > 0 && d > rp.MaxDelay {
+		d = rp.MaxDelay
+	}
+	return d
+}
+
+// retrier executes the retryPolicy on the channel of c.
+// It is safe for concurrent use.
+type retrier struct {
+	retryPolicy
+	mu       sync.Mutex // serializes publish-and-confirm
+	c        *amqpClient
+	queue    string
+	chunks   chunkStore
+	timeout  time.Duration
+	confirms chan amqp.Confirmation
+	// seq is the delivery tag of the last publishing, to match the confirmations with.
+	seq uint64
+}
+
+func newRetrier(c *amqpClient, queue string, rp retryPolicy, chunks chunkStore, timeout time.Duration) (*retrier, error) {
+	if rp.MaxAttempts < 1 {
+		rp.MaxAttempts = 1
+	}
+	r := &retrier{retryPolicy: rp, queue: queue, chunks: chunks, timeout: timeout}
+	if err := r.Reset(c); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reset switches to the channel of c, after a reconnection.
+func (r *retrier) Reset(c *amqpClient) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.DeadLetterQueue != "" {
+		if _, err := c.QueueDeclare(r.DeadLetterQueue, true, false, false, false, nil); err != nil {
+			return errgo.Notef(err, "QueueDeclare(%q)", r.DeadLetterQueue)
+		}
+		if r.DeadLetterExchange != "" {
+			if err := c.QueueBind(r.DeadLetterQueue, r.DeadLetterQueue, r.DeadLetterExchange, false, nil); err != nil {
+				return errgo.Notef(err, "QueueBind(%q, %q)", r.DeadLetterQueue, r.DeadLetterExchange)
+			}
+		}
+	}
+	if err := c.Confirm(false); err != nil {
+		return errgo.Notef(err, "Confirm")
+	}
+	r.c, r.seq = c, 0
+	r.confirms = c.NotifyPublish(make(chan amqp.Confirmation, 1))
+	return nil
+}
+
+// Fail republishes msg for a delayed retry, or dead-letters it when it has run
+// out of attempts (or the failure is permanent), and ACKs it.
+// deadLettered reports the latter: it's the final outcome of msg.
+//
+// A failed ACK (e.g. msg came on a connection lost since) is only logged:
+// the broker will redeliver the message.
+//
+// transferID is the ID of the chunked transfer msg completed, if any.
+// A retried or dead-lettered transfer is republished chunk by chunk,
+// as the other chunks are ACKed already.
+func (r *retrier) Fail(msg amqp.Delivery, transferID string, cause error) (deadLettered bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	attempts, _ := headerInt(msg.Headers[hdrAttempts])
+	attempts++
+	pub := publishingOf(msg)
+	pub.Headers[hdrAttempts] = int32(attempts)
+	if _, ok := pub.Headers[hdrOriginalUserID]; !ok && msg.UserId != "" {
+		pub.Headers[hdrOriginalUserID] = msg.UserId
+	}
+
+	if int(attempts) < r.MaxAttempts && !isPermanent(cause) {
+		d := r.delay(int(attempts))
+		dq, err := r.declareDelayQueue(d)
+		if err != nil {
+			return false, err
+		}
+		log.Printf("%q failed (%v), retrying in %s (attempt %d of %d).",
+			msg.MessageId, cause, d, attempts+1, r.MaxAttempts)
+		if err := r.republish("", dq, transferID, pub); err != nil {
+			return false, err
+		}
+		r.ack(msg)
+		return false, nil
+	}
+
+	pub.Headers[hdrError] = cause.Error()
+	if he, ok := errgo.Cause(cause).(*handlerError); ok {
+		pub.Headers[hdrExitCode] = int32(he.ExitCode)
+		pub.Headers[hdrStderr] = string(he.Stderr)
+	}
+	log.Printf("%q failed (%v) %d times, dead-lettering it to %q/%q.",
+		msg.MessageId, cause, attempts, r.DeadLetterExchange, r.DeadLetterQueue)
+	if err := r.republish(r.DeadLetterExchange, r.DeadLetterQueue, transferID, pub); err != nil {
+		return false, err
+	}
+	r.ack(msg)
+	return true, nil
+}
+
+// republish pub, or if transferID is not empty, all the chunks of the transfer
+// with the headers of pub, then remove the transfer.
+func (r *retrier) republish(exchange, key, transferID string, pub amqp.Publishing) error {
+	if transferID == "" {
+		return r.publish(exchange, key, pub)
+	}
+	if err := r.chunks.Republish(transferID, pub, func(pub amqp.Publishing) error {
+		return r.publish(exchange, key, pub)
+	}); err != nil {
+		return err
+	}
+	if err := r.chunks.Done(transferID); err != nil {
+		log.Printf("Remove transfer %s: %v", transferID, err)
+	}
+	return nil
+}
+
+func (r *retrier) ack(msg amqp.Delivery) {
+	if err := msg.Ack(false); err != nil {
+		log.Printf("cannot ACK %q: %v", msg.MessageId, err)
+	}
+}
+
+// declareDelayQueue declares the queue which delays messages for d,
+// then dead-letters them back to the queue.
+func (r *retrier) declareDelayQueue(d time.Duration) (string, error) {
+	name := fmt.Sprintf("%s.retry.%s", r.queue, d)
+	if _, err := r.c.QueueDeclare(name, true, false, false, false, amqp.Table{
+		"x-message-ttl":             int32(d / time.Millisecond),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": r.queue,
+	}); err != nil {
+		return "", errgo.Notef(err, "QueueDeclare(%q)", name)
+	}
+	return name, nil
+}
+
+// Publish the message, and wait for its confirmation.
+func (r *retrier) Publish(exchange, key string, pub amqp.Publishing) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.publish(exchange, key, pub)
+}
+
+func (r *retrier) publish(exchange, key string, pub amqp.Publishing) error {
+	if err := r.c.Publish(exchange, key, false, false, pub); err != nil {
+		return errgo.Notef(err, "Publish(%q, %q)", exchange, key)
+	}
+	r.seq++
+	timer := time.NewTimer(r.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case c, ok := <-r.confirms:
+			if !ok {
+				return errgo.New("channel closed")
+			}
+			if c.DeliveryTag < r.seq {
+				// of an earlier publishing, which has timed out already
+				log.Printf("Late confirmation of %d, ignoring it.", c.DeliveryTag)
+				continue
+			}
+			if c.DeliveryTag != r.seq {
+				return errgo.Newf("%q/%q: got confirmation of %d, wanted %d", exchange, key, c.DeliveryTag, r.seq)
+			}
+			if !c.Ack {
+				return errgo.Newf("%q/%q NACKed %d", exchange, key, c.DeliveryTag)
+			}
+			return nil
+		case <-timer.C:
+			return errgo.Newf("no confirmation from %q/%q in %s", exchange, key, r.timeout)
+		}
+	}
+}
+
+// publishingOf returns a Publishing with the properties, headers and body of d.
+// The user ID is left out, as the broker accepts only the connecting user's.
+func publishingOf(d amqp.Delivery) amqp.Publishing {
+	headers := make(amqp.Table, len(d.Headers)+1)
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
+
+// handlerError is returned by receive when the handler command fails.
+type handlerError struct {
+	*handlerResult
+	Err error
+}
+
+func (he *handlerError) Error() string { return fmt.Sprintf("%q: %v", he.Args, he.Err) }
+
+// permanentError is a failure retrying won't help, e.g. an undecryptable message:
+// such messages are dead-lettered at once.
+type permanentError struct {
+	Err error
+}
+
+func (pe *permanentError) Error() string { return pe.Err.Error() }
+
+// isPermanent reports whether err is, or is annotating, a *permanentError.
+func isPermanent(err error) bool {
+	for err != nil {
+		if _, ok := err.(*permanentError); ok {
+			return true
+		}
+		u, ok := err.(interface {
+			Underlying() error
+		})
+		if !ok {
+			return false
+		}
+		err = u.Underlying()
+	}
+	return false
+}
+
+// tailWriter keeps the last Size bytes written to it.
+type tailWriter struct {
+	Size int
+	buf  []byte
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.Size {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.Size:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailWriter) Bytes() []byte { return t.buf }
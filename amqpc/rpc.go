@@ -0,0 +1,151 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+// rpcReply is the body of the reply sub sends to the ReplyTo queue of a message,
+// after running the handler.
+type rpcReply struct {
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error,omitempty"`
+	Stdout   string `json:"stdout,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Attempt  int64  `json:"attempt"`
+	// Duplicate is true if the content has been processed already.
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// Reply sends the outcome of the handler (res and err) to msg.ReplyTo.
+func (r *retrier) Reply(msg amqp.Delivery, res *handlerResult, err error) error {
+	attempts, _ := headerInt(msg.Headers[hdrAttempts])
+	reply := rpcReply{Attempt: attempts + 1}
+	if res != nil {
+		reply.ExitCode = res.ExitCode
+		reply.Stdout = string(res.Stdout)
+		reply.Duration = res.Duration.String()
+		reply.Duplicate = res.Duplicate
+	}
+	if err != nil {
+		reply.Error = err.Error()
+		if reply.ExitCode == 0 {
+			reply.ExitCode = -1
+		}
+	}
+	b, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	return r.Publish("", msg.ReplyTo, amqp.Publishing{
+		Headers:       amqp.Table{hdrExitCode: int32(reply.ExitCode)},
+		ContentType:   "application/json",
+		CorrelationId: msg.CorrelationId,
+		Timestamp:     time.Now(),
+		Body:          b,
+	})
+}
+
+// replyWaiter collects the replies for the published messages
+// on an exclusive callback queue.
+type replyWaiter struct {
+	Queue   string
+	replies <-chan amqp.Delivery
+	// pending maps the correlation IDs to the names of the inputs.
+	pending map[string]string
+}
+
+func newReplyWaiter(c *amqpClient) (*replyWaiter, error) {
+	q, err := c.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return nil, errgo.Notef(err, "declare callback queue")
+	}
+	replies, err := c.Consume(q.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return nil, errgo.Notef(err, "Consume(%q)", q.Name)
+	}
+	return &replyWaiter{Queue: q.Name, replies: replies, pending: make(map[string]string)}, nil
+}
+
+// Prepare sets ReplyTo and, if not set yet, a new CorrelationId on pub,
+// which will be waited for.
+func (w *replyWaiter) Prepare(pub *amqp.Publishing, name string) error {
+	if pub.CorrelationId == "" {
+		id, err := newID()
+		if err != nil {
+			return err
+		}
+		pub.CorrelationId = id
+	}
+	if _, ok := w.pending[pub.CorrelationId]; ok {
+		return errgo.Newf("correlation ID %q is already used", pub.CorrelationId)
+	}
+	pub.ReplyTo = w.Queue
+	w.pending[pub.CorrelationId] = name
+	return nil
+}
+
+// Wait for all the replies.
+//
+// Returns error on the first failed handler, or when the timeout passes
+// without receiving all the replies.
+func (w *replyWaiter) Wait(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for len(w.pending) != 0 {
+		select {
+		case d, ok := <-w.replies:
+			if !ok {
+				return errgo.New("reply channel closed")
+			}
+			name, ok := w.pending[d.CorrelationId]
+			if !ok {
+				log.Printf("Unexpected reply %q.", d.CorrelationId)
+				continue
+			}
+			delete(w.pending, d.CorrelationId)
+			var reply rpcReply
+			if err := json.Unmarshal(d.Body, &reply); err != nil {
+				return errgo.Notef(err, "parse reply %q", d.Body)
+			}
+			if reply.Duplicate {
+				log.Printf("%q has been processed already.", name)
+				continue
+			}
+			log.Printf("%q processed in %s (attempt %d): exit code %d", name, reply.Duration, reply.Attempt, reply.ExitCode)
+			if reply.Stdout != "" {
+				log.Printf("%q output:\n%s", name, reply.Stdout)
+			}
+			if reply.ExitCode != 0 {
+				return errgo.Newf("processing of %q failed with %d: %s", name, reply.ExitCode, reply.Error)
+			}
+		case <-timer.C:
+			names := make([]string, 0, len(w.pending))
+			for _, name := range w.pending {
+				names = append(names, name)
+			}
+			return errgo.Newf("no reply for %q in %s", names, timeout)
+		}
+	}
+	return nil
+}
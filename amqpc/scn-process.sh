@@ -1,4 +1,11 @@
 #!/bin/sh -e
+# The same as a built-in pipeline of amqpc sub, to be migrated a step at a time:
+#   amqpc sub --pipeline "sniff(image/* application/zip) -> unzip -> each-page(
+#     exec(optimize2bw -n -i {in} -o {out.png}) ->
+#     filter(sh -c '! empty-page -i \"\$1\" 2>&1 | grep -q ^empty' - {in}) ->
+#     exec(nice -n 10 unpaper {in} {out.png}) ->
+#     exec(camput file -permanode -tag scan {in})) ->
+#   assemble-pdf -> exec(gdrive upload -f {in})"
 pnm2png () {
 	fn="$1"
 	D=$(cd $(dirname $fn); pwd)
@@ -26,7 +33,8 @@ date
 set -x
 fn="$1"
 . $HOME/.profile
-MIME=$(file -i "$fn")
+# amqpc sub passes the message's content type in AMQP_CONTENT_TYPE
+MIME=${AMQP_CONTENT_TYPE:-$(file -i "$fn")}
 if echo "$MIME" | grep -q 'image/'; then
 	echo "MIME=$MIME"
 elif echo "$MIME" | grep -q 'application/zip'; then
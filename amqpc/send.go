@@ -0,0 +1,273 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/magic"
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+// sender publishes the arguments of pub: literal text, @file, or @- for stdin.
+//
+// Files are compressed (according to Compress), encrypted to Recipient
+// and signed by Signer (if set), and sent in chunks if bigger than ChunkSize.
+// The SHA-256 of the content (before compression) is sent in the ContentSha256
+// header, and is the message ID, too, unless MessageID is set.
+type sender struct {
+	Exchange, Key string
+	// Headers are added to every message.
+	Headers amqp.Table
+
+	AppID, Type, Expiration  string
+	MessageID, CorrelationID string
+	Priority                 uint8
+	Compress                 string
+	ChunkSize                int
+	Recipient                *cryptKey
+	Signer                   *signer
+	// Replies, if not nil, waits for the replies of the sent messages.
+	Replies *replyWaiter
+	// Retries is the number of republishings of a NACKed or returned message.
+	Retries int
+	// Batch says whether SendAll sends the args as a batch (see SendBatch).
+	Batch bool
+}
+
+// Send publishes arg with pb, as mandatory message(s).
+func (s sender) Send(pb *publisher, arg string) error {
+	_, err := s.send(pb, arg)
+	return err
+}
+
+// send is Send, returning the content hash of arg, too.
+func (s sender) send(pb *publisher, arg string) (string, error) {
+	// the publisher may hold the message till confirmation, so don't reuse it
+	tbl := make(amqp.Table, len(s.Headers)+1)
+	for k, v := range s.Headers {
+		tbl[k] = v
+	}
+	var r io.ReadCloser
+	// the hash of the content, before compression and encryption
+	h := sha256.New()
+	mimeType, contentEncoding := "text/plain", ""
+	if strings.HasPrefix(arg, "@") {
+		arg = arg[1:]
+		if arg == "-" {
+			r = teeReadCloser(os.Stdin, h)
+		} else if fh, err := os.Open(arg); err != nil {
+			return "", err
+		} else {
+			var head []byte
+			if mimeType = mime.TypeByExtension(filepath.Ext(arg)); mimeType == "" {
+				// sniff the type before compression
+				head = make([]byte, 1024)
+				n, err := io.ReadFull(fh, head)
+				if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+					fh.Close()
+					return "", err
+				}
+				head = head[:n]
+				if mimeType = magic.MIMEType(head); mimeType == "" {
+					mimeType = "application/octet-stream"
+				}
+			}
+			r = teeReadCloser(struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(head), fh), fh}, h)
+			cd, err := chooseCodec(s.Compress, mimeType)
+			if err != nil {
+				fh.Close()
+				return "", err
+			}
+			if cd.Name != "" {
+				r = compressReader(r, cd)
+				contentEncoding = cd.Name
+			}
+			tbl["FileName"] = arg
+			if err := tbl.Validate(); err != nil {
+				r.Close()
+				return "", err
+			}
+		}
+	} else {
+		r = teeReadCloser(ioutil.NopCloser(strings.NewReader(arg)), h)
+	}
+	if s.Recipient != nil {
+		// compressed first, as the ciphertext is incompressible
+		var err error
+		if r, err = encryptReader(r, s.Recipient); err != nil {
+			return "", err
+		}
+		tbl[hdrEncryption] = encryptionScheme
+		tbl[hdrKeyID] = keyID(s.Recipient[:])
+	}
+	// Read one byte more than the chunk size, to know whether chunking is needed.
+	b, err := ioutil.ReadAll(&io.LimitedReader{R: r, N: int64(s.ChunkSize) + 1})
+	if err != nil {
+		r.Close()
+		return "", err
+	}
+	var fh *os.File
+	if len(b) > s.ChunkSize {
+		fh, err = spoolToTemp(b, r)
+		if err != nil {
+			r.Close()
+			return "", err
+		}
+		defer func() {
+			fh.Close()
+			os.Remove(fh.Name())
+		}()
+	}
+	r.Close()
+	// all the content has been read, so the hash is complete
+	contentHash := hex.EncodeToString(h.Sum(nil))
+	tbl[hdrContentHash] = contentHash
+
+	pub := amqp.Publishing{
+		Headers:         tbl,
+		DeliveryMode:    amqp.Persistent,
+		ContentType:     mimeType,
+		ContentEncoding: contentEncoding,
+		AppId:           s.AppID,
+		Priority:        s.Priority,
+		Expiration:      s.Expiration,
+		Type:            s.Type,
+		MessageId:       s.MessageID,
+		CorrelationId:   s.CorrelationID,
+		Timestamp:       time.Now(),
+	}
+	if pub.MessageId == "" {
+		// the same content gets the same ID, so sub can skip the duplicates
+		pub.MessageId = contentHash
+	}
+	if s.Replies != nil {
+		if err := s.Replies.Prepare(&pub, arg); err != nil {
+			return "", err
+		}
+	}
+	if fh == nil {
+		pub.Body = b
+		if s.Signer != nil {
+			sum := sha256.Sum256(b)
+			s.Signer.Sign(&pub, sum[:])
+		}
+		if err := pb.Publish("", spooledMessage{Exchange: s.Exchange, Key: s.Key, Mandatory: true, Publishing: pub}); err != nil {
+			return "", err
+		}
+		log.Printf("Sent %q", arg)
+		return contentHash, nil
+	}
+
+	if s.Signer != nil {
+		sum, err := hashSeeker(fh)
+		if err != nil {
+			return "", err
+		}
+		s.Signer.Sign(&pub, sum)
+	}
+	n, err := publishChunked(pb, s.Exchange, s.Key, pub, fh, s.ChunkSize)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Sent %q in %d chunks", arg, n)
+	return contentHash, nil
+}
+
+// teeReadCloser returns a ReadCloser which writes to w what it reads from r.
+func teeReadCloser(r io.ReadCloser, w io.Writer) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(r, w), r}
+}
+
+// SendAll sends the args through c (nil for spooling them all),
+// then waits for the confirmations, and for the replies if replyTimeout is not zero
+// and nothing is spooled (the spooled messages would miss the deadline).
+// c is closed at the end.
+//
+// A failing arg doesn't stop the rest: the outcome of each arg is in the
+// publisher's Results.
+//
+// Returns the publisher for its counters and results, or nil if it couldn't be created.
+func (s sender) SendAll(c *amqpClient, sp spool, timeout time.Duration, args []string, replyTimeout time.Duration) (*publisher, error) {
+	if replyTimeout != 0 && c != nil {
+		var err error
+		if s.Replies, err = newReplyWaiter(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	pb, err := newPublisher(c, sp, timeout)
+	if err != nil {
+		if c != nil {
+			c.Close()
+		}
+		return nil, err
+	}
+	pb.Retries = s.Retries
+	if s.Batch {
+		if err := s.SendBatch(pb, args); err != nil {
+			pb.Close()
+			return pb, err
+		}
+	} else {
+		for _, arg := range args {
+			pb.Begin(arg)
+			if err := s.Send(pb, arg); err != nil {
+				log.Printf("Send %q: %v", arg, err)
+				pb.Fail(arg, err)
+			}
+		}
+	}
+	if err := pb.Flush(); err != nil {
+		pb.Close()
+		return pb, err
+	}
+	if replyTimeout != 0 {
+		if s.Replies == nil || pb.Spooled != 0 {
+			log.Printf("Messages are spooled, not waiting for the replies.")
+			return pb, pb.Close()
+		}
+		for _, r := range pb.Results() {
+			if r.Status() != "delivered" {
+				pb.Close()
+				return pb, errgo.Newf("%q is not delivered, cannot wait for the replies", r.Item)
+			}
+		}
+		if err := s.Replies.Wait(replyTimeout); err != nil {
+			pb.Close()
+			return pb, err
+		}
+	}
+	return pb, pb.Close()
+}
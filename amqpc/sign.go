@@ -0,0 +1,202 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+// Headers of a signed message.
+const (
+	hdrSignature     = "Signature"
+	hdrSignerID      = "SignerId"
+	hdrSignedHeaders = "SignedHeaders"
+)
+
+// signer signs the messages with an Ed25519 key.
+//
+// The signature covers the SHA-256 hash of the body (as sent: compressed and encrypted),
+// the main properties (MessageId, CorrelationId, ReplyTo, Type, ContentType,
+// ContentEncoding, AppId, Timestamp), and the headers listed in the SignedHeaders
+// header (an array of their names, as any character may be in a name):
+// all the headers the message had when signed.
+// The chunk and retry headers are added later, so they aren't signed.
+type signer struct {
+	Key ed25519.PrivateKey
+	ID  string
+}
+
+// readSigner reads the signing key (the seed, as written by keygen --sign) from fn.
+func readSigner(fn string) (signer, error) {
+	seed, err := readKeyFile(fn)
+	if err != nil {
+		return signer{}, err
+	}
+	key := ed25519.NewKeyFromSeed(seed[:])
+	return signer{Key: key, ID: keyID(key.Public().(ed25519.PublicKey))}, nil
+}
+
+// generateSigningKey returns the seed of a new Ed25519 key, and its public key.
+func generateSigningKey() (seed []byte, pub ed25519.PublicKey, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv.Seed(), pub, nil
+}
+
+// Sign adds the signature of pub (with a body hashed to bodySum) to its headers.
+func (s signer) Sign(pub *amqp.Publishing, bodySum []byte) {
+	names := make([]string, 0, len(pub.Headers))
+	for k := range pub.Headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	sig := ed25519.Sign(s.Key, signedText(*pub, names, bodySum))
+	list := make([]interface{}, len(names))
+	for i, k := range names {
+		list[i] = k
+	}
+	pub.Headers[hdrSignedHeaders] = list
+	pub.Headers[hdrSignerID] = s.ID
+	pub.Headers[hdrSignature] = base64.StdEncoding.EncodeToString(sig)
+}
+
+// signedText returns the canonical form of the signed parts of pub.
+// Every field is length-prefixed, so no value can pass for another.
+func signedText(pub amqp.Publishing, names []string, bodySum []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("amqpc-signature-v1\n")
+	add := func(k, v string) { fmt.Fprintf(&buf, "%s:%d:%s\n", k, len(v), v) }
+	add("message-id", pub.MessageId)
+	add("correlation-id", pub.CorrelationId)
+	add("reply-to", pub.ReplyTo)
+	add("type", pub.Type)
+	add("content-type", pub.ContentType)
+	add("content-encoding", pub.ContentEncoding)
+	add("app-id", pub.AppId)
+	add("timestamp", fmt.Sprintf("%d", pub.Timestamp.Unix()))
+	for _, k := range names {
+		add("header", k)
+		add("value", headerString(pub.Headers[k]))
+	}
+	add("body-sha256", fmt.Sprintf("%x", bodySum))
+	return buf.Bytes()
+}
+
+// trustedKey is the public key of a signer.
+type trustedKey struct {
+	Name string
+	Key  ed25519.PublicKey
+}
+
+// trustedKeys maps the key IDs to the trusted signers' keys.
+type trustedKeys map[string]trustedKey
+
+// readTrustedKeys reads the public keys from the *.pub files in dir.
+// The name of the signer is the file's name, without the .pub.
+func readTrustedKeys(dir string) (trustedKeys, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pub"))
+	if err != nil {
+		return nil, err
+	}
+	tk := make(trustedKeys, len(files))
+	for _, fn := range files {
+		k, err := readKeyFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(filepath.Base(fn), ".pub")
+		id := keyID(k[:])
+		if other, ok := tk[id]; ok {
+			log.Printf("Key %s of %q is the same as %q's.", id, name, other.Name)
+		}
+		tk[id] = trustedKey{Name: name, Key: ed25519.PublicKey(k[:])}
+	}
+	if len(tk) == 0 {
+		return nil, errgo.Newf("no trusted keys (*.pub) in %q", dir)
+	}
+	return tk, nil
+}
+
+// Verify the signature of pub (with a body hashed to bodySum),
+// and return the name of the signer.
+//
+// Unsigned, badly signed messages and the ones from unknown signers
+// are reported as *permanentError.
+func (tk trustedKeys) Verify(pub amqp.Publishing, bodySum []byte) (string, error) {
+	sig := headerString(pub.Headers[hdrSignature])
+	if sig == "" {
+		return "", &permanentError{Err: errgo.New("message is not signed")}
+	}
+	id := headerString(pub.Headers[hdrSignerID])
+	k, ok := tk[id]
+	if !ok {
+		return "", &permanentError{Err: errgo.Newf("unknown signer %q", id)}
+	}
+	b, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return "", &permanentError{Err: errgo.Notef(err, "parse signature")}
+	}
+	var names []string
+	if v, ok := pub.Headers[hdrSignedHeaders]; ok {
+		list, ok := v.([]interface{})
+		if !ok {
+			return "", &permanentError{Err: errgo.Newf("%s is a %T, not an array", hdrSignedHeaders, v)}
+		}
+		names = make([]string, len(list))
+		for i, v := range list {
+			if names[i], ok = v.(string); !ok {
+				return "", &permanentError{Err: errgo.Newf("%s has a %T, not a name", hdrSignedHeaders, v)}
+			}
+		}
+	}
+	for _, name := range names {
+		if _, ok := pub.Headers[name]; !ok {
+			return "", &permanentError{Err: errgo.Newf("signed header %q is missing", name)}
+		}
+	}
+	if !ed25519.Verify(k.Key, signedText(pub, names, bodySum), b) {
+		return "", &permanentError{Err: errgo.Newf("bad signature of %q (%s)", k.Name, id)}
+	}
+	return k.Name, nil
+}
+
+// hashSeeker returns the SHA-256 hash of the content of rs, and rewinds it.
+func hashSeeker(rs io.ReadSeeker) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, rs); err != nil {
+		return nil, err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
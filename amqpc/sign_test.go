@@ -0,0 +1,49 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestSignHeaderNames(t *testing.T) {
+	seed, pk, err := generateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := ed25519.NewKeyFromSeed(seed)
+	s := signer{Key: key, ID: keyID(pk)}
+	tk := trustedKeys{s.ID: {Name: "alice", Key: pk}}
+
+	// with a comma-separated list, "a,b" would be "a" and "b"
+	pub := amqp.Publishing{MessageId: "m", Headers: amqp.Table{"a,b": "1", "c": "2"}}
+	s.Sign(&pub, []byte("sum"))
+	if name, err := tk.Verify(pub, []byte("sum")); err != nil || name != "alice" {
+		t.Fatal(name, err)
+	}
+	pub.Headers["a,b"] = "3"
+	if _, err := tk.Verify(pub, []byte("sum")); !isPermanent(err) {
+		t.Errorf("changed header: %v", err)
+	}
+	pub.Headers["a,b"] = "1"
+	pub.Headers[hdrSignedHeaders] = "a,b,c"
+	if _, err := tk.Verify(pub, []byte("sum")); !isPermanent(err) {
+		t.Errorf("list of names as a string: %v", err)
+	}
+}
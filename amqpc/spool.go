@@ -0,0 +1,173 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+func init() {
+	// The types amqp.Table may hold, besides the basic ones.
+	gob.Register(amqp.Table{})
+	gob.Register([]interface{}{})
+	gob.Register(amqp.Decimal{})
+	gob.Register(time.Time{})
+}
+
+// spoolSuffix is the extension of the spooled message files.
+const spoolSuffix = ".msg"
+
+// spooledMessage is a message waiting for publishing.
+type spooledMessage struct {
+	Exchange, Key string
+	Mandatory     bool
+	amqp.Publishing
+}
+
+// spool is a directory of messages which couldn't be delivered to the broker.
+//
+// Each message is a gob-encoded spooledMessage in its own file,
+// named by the time of spooling, so listing keeps the order of publishing.
+type spool struct {
+	Dir string
+}
+
+// defaultSpoolDir returns $XDG_DATA_HOME/amqpc/spool.
+func defaultSpoolDir() string { return filepath.Join(dataDir(), "spool") }
+
+// dataDir returns $XDG_DATA_HOME/amqpc.
+func dataDir() string {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".local", "share")
+	}
+	return filepath.Join(dir, "amqpc")
+}
+
+// Put writes the message into the spool, and returns its name.
+func (sp spool) Put(msg spooledMessage) (string, error) {
+	if sp.Dir == "" {
+		return "", errgo.New("no spool directory is given")
+	}
+	if err := os.MkdirAll(sp.Dir, 0700); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+		return "", errgo.Notef(err, "encode message")
+	}
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+	name := time.Now().UTC().Format("20060102T150405.000000000") + "-" + id[:8] + spoolSuffix
+	if err := writeFileAtomic(filepath.Join(sp.Dir, name), buf.Bytes()); err != nil {
+		return "", err
+	}
+	log.Printf("Spooled %q to %q.", msg.Headers["FileName"], name)
+	return name, nil
+}
+
+// List returns the names of the spooled messages, oldest first.
+func (sp spool) List() ([]string, error) {
+	fis, err := ioutil.ReadDir(sp.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	names := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), spoolSuffix) {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Get reads the named message from the spool.
+func (sp spool) Get(name string) (spooledMessage, error) {
+	var msg spooledMessage
+	b, err := ioutil.ReadFile(filepath.Join(sp.Dir, name))
+	if err != nil {
+		return msg, err
+	}
+	if err = gob.NewDecoder(bytes.NewReader(b)).Decode(&msg); err != nil {
+		return msg, errgo.Notef(err, "decode %q", name)
+	}
+	return msg, nil
+}
+
+// Remove the named message from the spool.
+func (sp spool) Remove(name string) error {
+	return os.Remove(filepath.Join(sp.Dir, name))
+}
+
+// flushSpool publishes the spooled messages through c,
+// and removes the ones confirmed by the broker. Closes c at the end.
+//
+// Returns the number of delivered messages.
+func flushSpool(c *amqpClient, sp spool, timeout time.Duration) (int, error) {
+	defer c.Close()
+	names, err := sp.List()
+	if err != nil || len(names) == 0 {
+		return 0, err
+	}
+	log.Printf("Flushing %d spooled messages from %q.", len(names), sp.Dir)
+	p, err := newPublisher(c, sp, timeout)
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		msg, err := sp.Get(name)
+		if err != nil {
+			log.Printf("Skipping %q: %v", name, err)
+			continue
+		}
+		if err := p.Publish(name, msg); err != nil {
+			p.Close()
+			return p.Delivered, err
+		}
+		if p.Offline() != nil {
+			break
+		}
+	}
+	if err := p.Close(); err != nil {
+		return p.Delivered, err
+	}
+	if err := p.Offline(); err != nil {
+		return p.Delivered, err
+	}
+	if p.Delivered < len(names) {
+		return p.Delivered, fmt.Errorf("%d of %d spooled messages remained", len(names)-p.Delivered, len(names))
+	}
+	return p.Delivered, nil
+}
@@ -0,0 +1,362 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // for image.Decode
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"camlistore.org/pkg/magic"
+	"gopkg.in/errgo.v1"
+)
+
+func init() {
+	registerStage("sniff", "sniff(TYPE...): set the content type of the artifacts (if not known), keep only the ones matching a TYPE pattern, e.g. image/*", newSniffStage)
+	registerStage("unzip", "unzip: replace the zip artifacts (by their type, or their content) with their files, in name order", newUnzipStage)
+	registerStage("assemble-pdf", "assemble-pdf(DPI): make a PDF of the image artifacts, a page each (default DPI is 300)", newAssemblePDFStage)
+	registerStage("store", "store(DIR): copy the artifacts into DIR", newStoreStage)
+}
+
+// sniffType returns the content type of the file, by its content or its extension.
+func sniffType(fn string) (string, error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	head := make([]byte, 1024)
+	n, err := io.ReadFull(fh, head)
+	fh.Close()
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if typ := magic.MIMEType(head[:n]); typ != "" {
+		return typ, nil
+	}
+	if typ := mime.TypeByExtension(filepath.Ext(fn)); typ != "" {
+		return typ, nil
+	}
+	return "application/octet-stream", nil
+}
+
+func newSniffStage(arg string) (Handler, error) {
+	patterns := strings.Fields(arg)
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, errgo.Notef(err, "pattern %q", p)
+		}
+	}
+	return HandlerFunc(func(ctx context.Context, msg *Message) ([]Artifact, error) {
+		arts := make([]Artifact, 0, len(msg.Artifacts))
+		for _, a := range msg.Artifacts {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if a.ContentType == "" || a.ContentType == "application/octet-stream" {
+				var err error
+				if a.ContentType, err = sniffType(a.Path); err != nil {
+					return nil, err
+				}
+			}
+			typ, _, err := mime.ParseMediaType(a.ContentType)
+			if err != nil {
+				typ = a.ContentType
+			}
+			a.ContentType = typ
+			keep := len(patterns) == 0
+			for _, p := range patterns {
+				if ok, _ := path.Match(p, typ); ok {
+					keep = true
+					break
+				}
+			}
+			if !keep {
+				msg.Printf("# skipping %q: %s", a.Path, typ)
+				continue
+			}
+			arts = append(arts, a)
+		}
+		return arts, nil
+	}), nil
+}
+
+func newUnzipStage(arg string) (Handler, error) {
+	if arg != "" {
+		return nil, errgo.Newf("unzip has no argument, got %q", arg)
+	}
+	return HandlerFunc(func(ctx context.Context, msg *Message) ([]Artifact, error) {
+		var arts []Artifact
+		for _, a := range msg.Artifacts {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if ok, err := isZip(a); err != nil {
+				return nil, err
+			} else if !ok {
+				arts = append(arts, a)
+				continue
+			}
+			files, err := unzipFlat(ctx, a.Path, msg.Dir)
+			if err != nil {
+				return nil, errgo.Notef(err, "unzip %q", a.Path)
+			}
+			for _, fn := range files {
+				arts = append(arts, Artifact{Path: fn, ContentType: mime.TypeByExtension(filepath.Ext(fn))})
+			}
+		}
+		return arts, nil
+	}), nil
+}
+
+// isZip reports whether the artifact is a zip archive: by its content type,
+// or as that may be missing or wrong (e.g. unzip without sniff before it), by its signature.
+func isZip(a Artifact) (bool, error) {
+	switch a.ContentType {
+	case "application/zip", "application/x-zip-compressed":
+		return true, nil
+	}
+	fh, err := os.Open(a.Path)
+	if err != nil {
+		return false, err
+	}
+	defer fh.Close()
+	head := make([]byte, len(zipSignature))
+	if _, err := io.ReadFull(fh, head); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return string(head) == zipSignature, nil
+}
+
+// zipSignature is the start of a (non-empty) zip archive: its first local file header.
+const zipSignature = "PK\x03\x04"
+
+// unzipFlat extracts the files of the zip archive into dir, without their paths
+// (like unzip -j), and returns them in name order.
+// It stops when ctx is done.
+func unzipFlat(ctx context.Context, fn, dir string) ([]string, error) {
+	zr, err := zip.OpenReader(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	files := make([]*zip.File, 0, len(zr.File))
+	for _, f := range zr.File {
+		if f.Mode().IsRegular() && sanitizeName(f.Name) != "" {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return sanitizeName(files[i].Name) < sanitizeName(files[j].Name) })
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return paths, err
+		}
+		r, err := f.Open()
+		if err != nil {
+			return paths, err
+		}
+		p, err := writeNoClobber(filepath.Join(dir, sanitizeName(f.Name)), r)
+		r.Close()
+		if err != nil {
+			return paths, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+func newStoreStage(arg string) (Handler, error) {
+	dest := strings.TrimSpace(arg)
+	if dest == "" {
+		return nil, errgo.New("store needs a DIR")
+	}
+	return HandlerFunc(func(ctx context.Context, msg *Message) ([]Artifact, error) {
+		arts := make([]Artifact, 0, len(msg.Artifacts))
+		for _, a := range msg.Artifacts {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			fh, err := os.Open(a.Path)
+			if err != nil {
+				return nil, err
+			}
+			p, err := writeNoClobber(filepath.Join(dest, filepath.Base(a.Path)), fh)
+			fh.Close()
+			if err != nil {
+				return nil, errgo.Notef(err, "store %q", a.Path)
+			}
+			msg.Printf("# stored %q", p)
+			arts = append(arts, Artifact{Path: p, ContentType: a.ContentType})
+		}
+		return arts, nil
+	}), nil
+}
+
+func newAssemblePDFStage(arg string) (Handler, error) {
+	dpi := 300
+	if arg = strings.TrimSpace(arg); arg != "" {
+		var err error
+		if dpi, err = strconv.Atoi(arg); err != nil || dpi <= 0 {
+			return nil, errgo.Newf("DPI must be a positive integer, got %q", arg)
+		}
+	}
+	return HandlerFunc(func(ctx context.Context, msg *Message) ([]Artifact, error) {
+		base := strings.TrimSuffix(filepath.Base(msg.Path), filepath.Ext(msg.Path))
+		fh, err := os.Create(filepath.Join(msg.Dir, base+".pdf"))
+		if err != nil {
+			return nil, err
+		}
+		err = writePDF(ctx, fh, msg.Artifacts, dpi)
+		if closeErr := fh.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(fh.Name())
+			return nil, err
+		}
+		return []Artifact{{Path: fh.Name(), ContentType: "application/pdf"}}, nil
+	}), nil
+}
+
+// writePDF writes a PDF to w with the images, a page each, sized by dpi.
+// The images are stored as Flate-compressed grayscale or RGB samples.
+// It stops when ctx is done.
+func writePDF(ctx context.Context, w io.Writer, images []Artifact, dpi int) error {
+	bw := bufio.NewWriter(w)
+	var offsets []int64
+	var pos int64
+	write := func(format string, args ...interface{}) {
+		n, _ := fmt.Fprintf(bw, format, args...)
+		pos += int64(n)
+	}
+	// objects: 1 catalog, 2 pages, then for each page: page, content, image
+	object := func(format string, args ...interface{}) {
+		offsets = append(offsets, pos)
+		write("%d 0 obj\n", len(offsets))
+		write(format, args...)
+		write("\nendobj\n")
+	}
+	stream := func(dict string, data []byte) {
+		offsets = append(offsets, pos)
+		write("%d 0 obj\n<<%s /Length %d>>\nstream\n", len(offsets), dict, len(data))
+		n, _ := bw.Write(data)
+		pos += int64(n)
+		write("\nendstream\nendobj\n")
+	}
+
+	write("%%PDF-1.4\n%%\xe2\xe3\xcf\xd3\n")
+	kids := make([]string, len(images))
+	for i := range images {
+		kids[i] = fmt.Sprintf("%d 0 R", 3+3*i)
+	}
+	object("<</Type /Catalog /Pages 2 0 R>>")
+	object("<</Type /Pages /Kids [%s] /Count %d>>", strings.Join(kids, " "), len(images))
+	for i, a := range images {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		colorSpace, width, height, data, err := pdfImage(a.Path)
+		if err != nil {
+			return errgo.Notef(err, "page %d (%q)", i+1, a.Path)
+		}
+		pageNo := 3 + 3*i
+		w, h := float64(width)*72/float64(dpi), float64(height)*72/float64(dpi)
+		object("<</Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Contents %d 0 R /Resources <</XObject <</Im0 %d 0 R>>>>>>",
+			w, h, pageNo+1, pageNo+2)
+		stream("", []byte(fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q", w, h)))
+		stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /%s /BitsPerComponent 8 /Filter /FlateDecode",
+			width, height, colorSpace), data)
+	}
+	xref := pos
+	write("xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		write("%010d 00000 n \n", off)
+	}
+	write("trailer\n<</Size %d /Root 1 0 R>>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return bw.Flush()
+}
+
+// pdfImage decodes the image file, and returns its samples Flate-compressed,
+// in DeviceGray if all its pixels are gray, else in DeviceRGB.
+func pdfImage(fn string) (colorSpace string, width, height int, data []byte, err error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return "", 0, 0, nil, err
+	}
+	img, _, err := image.Decode(bufio.NewReader(fh))
+	fh.Close()
+	if err != nil {
+		return "", 0, 0, nil, err
+	}
+	b := img.Bounds()
+	width, height = b.Dx(), b.Dy()
+	gray := true
+	switch img.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+	default:
+		for y := b.Min.Y; y < b.Max.Y && gray; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl, _ := img.At(x, y).RGBA()
+				if r != g || g != bl {
+					gray = false
+					break
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	row := make([]byte, 0, 3*width)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row = row[:0]
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if gray {
+				row = append(row, color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+				continue
+			}
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			row = append(row, c.R, c.G, c.B)
+		}
+		zw.Write(row)
+	}
+	if err := zw.Close(); err != nil {
+		return "", 0, 0, nil, err
+	}
+	colorSpace = "DeviceRGB"
+	if gray {
+		colorSpace = "DeviceGray"
+	}
+	return colorSpace, width, height, buf.Bytes(), nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+// tlsOptions configure the TLS connection (amqps://) to the broker.
+type tlsOptions struct {
+	// CA is the PEM file of the CA certificates the server's certificate
+	// is verified with, instead of the system's.
+	CA string
+	// Cert and Key are the PEM files of the client certificate.
+	Cert, Key string
+	// ServerName is the name the server's certificate is verified for,
+	// instead of the host in the URL.
+	ServerName string
+	// External authenticates with the client certificate (SASL EXTERNAL),
+	// instead of the user and password in the URL.
+	External bool
+}
+
+// IsZero reports whether no TLS option is set.
+func (o tlsOptions) IsZero() bool { return o == tlsOptions{} }
+
+// Config returns the connection config for server, with the TLS options.
+//
+// The files are read on each call, so a reconnection picks up the renewed certificates.
+func (o tlsOptions) Config(server string) (amqp.Config, error) {
+	cfg := amqp.Config{Heartbeat: 10 * time.Second, Locale: "en_US"}
+	if o.IsZero() {
+		return cfg, nil
+	}
+	uri, err := amqp.ParseURI(server)
+	if err != nil {
+		return cfg, errgo.Notef(err, "parse %q", server)
+	}
+	if uri.Scheme != "amqps" {
+		return cfg, errgo.Newf("the TLS options need an amqps:// server URL, got %q", uri.Scheme+"://")
+	}
+	tc := &tls.Config{ServerName: o.ServerName}
+	if o.CA != "" {
+		b, err := ioutil.ReadFile(o.CA)
+		if err != nil {
+			return cfg, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(b) {
+			return cfg, errgo.Newf("no certificates found in %q", o.CA)
+		}
+	}
+	if o.Cert != "" || o.Key != "" {
+		if o.Cert == "" || o.Key == "" {
+			return cfg, errgo.New("the client certificate needs both --tls-cert and --tls-key")
+		}
+		cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return cfg, errgo.Notef(err, "load %q and %q", o.Cert, o.Key)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	if o.External {
+		if len(tc.Certificates) == 0 {
+			return cfg, errgo.New("EXTERNAL authentication needs a client certificate")
+		}
+		cfg.SASL = []amqp.Authentication{externalAuth{}}
+	}
+	cfg.TLSClientConfig = tc
+	return cfg, nil
+}
+
+// externalAuth is the SASL EXTERNAL mechanism: the broker takes the identity
+// from the client certificate (e.g. RabbitMQ's rabbitmq_auth_mechanism_ssl plugin).
+type externalAuth struct{}
+
+func (externalAuth) Mechanism() string { return "EXTERNAL" }
+func (externalAuth) Response() string  { return "" }
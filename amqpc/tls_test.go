@@ -0,0 +1,376 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+func TestTLSConfigOptions(t *testing.T) {
+	certs := newTestCerts(t)
+	defer os.RemoveAll(certs.Dir)
+	for i, tc := range []struct {
+		opts     tlsOptions
+		server   string
+		err      string
+		tls      bool
+		external bool
+	}{
+		{server: "amqp://a:b@h/"},
+		{opts: tlsOptions{ServerName: "x"}, server: "amqp://a:b@h/", err: "amqps://"},
+		{opts: tlsOptions{ServerName: "x"}, server: "amqps://a:b@h/", tls: true},
+		{opts: tlsOptions{CA: certs.CA}, server: "amqps://h/", tls: true},
+		{opts: tlsOptions{CA: certs.ClientKey}, server: "amqps://h/", err: "no certificates"},
+		{opts: tlsOptions{CA: filepath.Join(certs.Dir, "nothing")}, server: "amqps://h/", err: "nothing"},
+		{opts: tlsOptions{Cert: certs.ClientCert}, server: "amqps://h/", err: "both"},
+		{opts: tlsOptions{Cert: certs.ClientCert, Key: certs.ServerKey}, server: "amqps://h/", err: "load"},
+		{opts: tlsOptions{Cert: certs.ClientCert, Key: certs.ClientKey}, server: "amqps://h/", tls: true},
+		{opts: tlsOptions{External: true}, server: "amqps://h/", err: "client certificate"},
+		{opts: tlsOptions{Cert: certs.ClientCert, Key: certs.ClientKey, External: true}, server: "amqps://h/", tls: true, external: true},
+	} {
+		cfg, err := tc.opts.Config(tc.server)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%d. %+v: got %v, wanted error with %q", i, tc.opts, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. %+v: %v", i, tc.opts, err)
+			continue
+		}
+		if (cfg.TLSClientConfig != nil) != tc.tls {
+			t.Errorf("%d. %+v: got TLS config %v", i, tc.opts, cfg.TLSClientConfig)
+		}
+		if external := len(cfg.SASL) == 1 && cfg.SASL[0].Mechanism() == "EXTERNAL"; external != tc.external {
+			t.Errorf("%d. %+v: got SASL %v", i, tc.opts, cfg.SASL)
+		}
+	}
+}
+
+// TestTLSDial connects to an in-process TLS listener, which speaks just enough AMQP
+// to see the SASL mechanism the client chooses.
+func TestTLSDial(t *testing.T) {
+	certs := newTestCerts(t)
+	defer os.RemoveAll(certs.Dir)
+	for i, tc := range []struct {
+		opts tlsOptions
+		// host is the host of the URL
+		host string
+		// clientCert says whether the server requires a client certificate
+		clientCert bool
+		// mechanisms are offered by the server
+		mechanisms string
+		// mechanism is the one chosen by the client, empty if it fails before choosing one
+		mechanism string
+	}{
+		// the server's certificate is not signed by a system CA
+		{host: "localhost", mechanisms: "PLAIN"},
+		{opts: tlsOptions{CA: certs.CA}, host: "localhost", mechanisms: "PLAIN", mechanism: "PLAIN"},
+		{opts: tlsOptions{CA: certs.CA}, host: "127.0.0.1", mechanisms: "PLAIN", mechanism: "PLAIN"},
+		// the server's certificate is not for this name
+		{opts: tlsOptions{CA: certs.CA, ServerName: "example.com"}, host: "localhost", mechanisms: "PLAIN"},
+		{opts: tlsOptions{CA: certs.CA, ServerName: "localhost"}, host: "127.0.0.1", mechanisms: "PLAIN", mechanism: "PLAIN"},
+		// no client certificate
+		{opts: tlsOptions{CA: certs.CA}, host: "localhost", clientCert: true, mechanisms: "PLAIN"},
+		{opts: tlsOptions{CA: certs.CA, Cert: certs.ClientCert, Key: certs.ClientKey},
+			host: "localhost", clientCert: true, mechanisms: "PLAIN EXTERNAL", mechanism: "PLAIN"},
+		{opts: tlsOptions{CA: certs.CA, Cert: certs.ClientCert, Key: certs.ClientKey, External: true},
+			host: "localhost", clientCert: true, mechanisms: "PLAIN EXTERNAL", mechanism: "EXTERNAL"},
+		// the server doesn't support EXTERNAL
+		{opts: tlsOptions{CA: certs.CA, Cert: certs.ClientCert, Key: certs.ClientKey, External: true},
+			host: "localhost", clientCert: true, mechanisms: "PLAIN", mechanism: ""},
+	} {
+		srv, err := newTLSTestServer(certs, tc.clientCert, tc.mechanisms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := "amqps://user:pass@" + tc.host + ":" + srv.Port + "/"
+		cfg, err := tc.opts.Config(server)
+		if err != nil {
+			srv.Close()
+			t.Fatalf("%d. %+v: %v", i, tc.opts, err)
+		}
+		if c, err := amqp.DialConfig(server, cfg); err == nil {
+			c.Close()
+			t.Errorf("%d. %+v: connected to a fake server", i, tc.opts)
+		}
+		srv.Close()
+		res := <-srv.Result
+		if tc.mechanism == "" {
+			if res.Err == nil && res.Mechanism != "" {
+				t.Errorf("%d. %+v: got %q, wanted failure", i, tc.opts, res.Mechanism)
+			}
+			continue
+		}
+		if res.Err != nil {
+			t.Errorf("%d. %+v: %v", i, tc.opts, res.Err)
+			continue
+		}
+		if res.Mechanism != tc.mechanism {
+			t.Errorf("%d. %+v: got %q, wanted %q", i, tc.opts, res.Mechanism, tc.mechanism)
+		}
+		if tc.mechanism == "PLAIN" && res.Response != "\x00user\x00pass" {
+			t.Errorf("%d. %+v: PLAIN response %q", i, tc.opts, res.Response)
+		}
+		if tc.mechanism == "EXTERNAL" && res.PeerName != "client" {
+			t.Errorf("%d. %+v: got peer %q, wanted client", i, tc.opts, res.PeerName)
+		}
+	}
+}
+
+// testCerts are the PEM files of a CA, and the server and client certificates signed by it.
+type testCerts struct {
+	Dir                   string
+	CA                    string
+	ServerCert, ServerKey string
+	ClientCert, ClientKey string
+	pool                  *x509.CertPool
+	server                tls.Certificate
+}
+
+func newTestCerts(t *testing.T) *testCerts {
+	dir, err := ioutil.TempDir("", "amqpc-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := &testCerts{Dir: dir,
+		CA:         filepath.Join(dir, "ca.pem"),
+		ServerCert: filepath.Join(dir, "server.pem"), ServerKey: filepath.Join(dir, "server-key.pem"),
+		ClientCert: filepath.Join(dir, "client.pem"), ClientKey: filepath.Join(dir, "client-key.pem"),
+	}
+	if err := certs.generate(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return certs
+}
+
+func (certs *testCerts) generate() error {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return err
+	}
+	certs.pool = x509.NewCertPool()
+	certs.pool.AddCert(ca)
+	if err := writePEM(certs.CA, "CERTIFICATE", caDER); err != nil {
+		return err
+	}
+
+	for i, c := range []struct {
+		tmpl          x509.Certificate
+		certFn, keyFn string
+	}{
+		{tmpl: x509.Certificate{
+			Subject:     pkix.Name{CommonName: "server"},
+			DNSNames:    []string{"localhost"},
+			IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, certFn: certs.ServerCert, keyFn: certs.ServerKey},
+		{tmpl: x509.Certificate{
+			Subject:     pkix.Name{CommonName: "client"},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, certFn: certs.ClientCert, keyFn: certs.ClientKey},
+	} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		tmpl := c.tmpl
+		tmpl.SerialNumber = big.NewInt(int64(i + 2))
+		tmpl.NotBefore, tmpl.NotAfter = now.Add(-time.Hour), now.Add(time.Hour)
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		der, err := x509.CreateCertificate(rand.Reader, &tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			return err
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		if err := writePEM(c.certFn, "CERTIFICATE", der); err != nil {
+			return err
+		}
+		if err := writePEM(c.keyFn, "EC PRIVATE KEY", keyDER); err != nil {
+			return err
+		}
+	}
+	certs.server, err = tls.LoadX509KeyPair(certs.ServerCert, certs.ServerKey)
+	return err
+}
+
+func writePEM(fn, typ string, der []byte) error {
+	return ioutil.WriteFile(fn, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+}
+
+// tlsTestServer accepts one TLS connection, offers the mechanisms in connection.start,
+// and reports what the client answers in connection.start-ok.
+type tlsTestServer struct {
+	net.Listener
+	Port   string
+	Result chan tlsTestResult
+	closed chan struct{}
+}
+
+// Close the listener, and the connection: the client may leave it open on failure.
+func (srv *tlsTestServer) Close() error {
+	close(srv.closed)
+	return srv.Listener.Close()
+}
+
+type tlsTestResult struct {
+	Mechanism, Response string
+	// PeerName is the common name of the client certificate.
+	PeerName string
+	Err      error
+}
+
+func newTLSTestServer(certs *testCerts, clientCert bool, mechanisms string) (*tlsTestServer, error) {
+	tc := &tls.Config{Certificates: []tls.Certificate{certs.server}}
+	if clientCert {
+		tc.ClientAuth, tc.ClientCAs = tls.RequireAndVerifyClientCert, certs.pool
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tc)
+	if err != nil {
+		return nil, err
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	srv := &tlsTestServer{Listener: ln, Port: port, Result: make(chan tlsTestResult, 1), closed: make(chan struct{})}
+	go func() {
+		var res tlsTestResult
+		res.Mechanism, res.Response, res.PeerName, res.Err = srv.serve(mechanisms)
+		srv.Result <- res
+	}()
+	return srv, nil
+}
+
+func (srv *tlsTestServer) serve(mechanisms string) (mechanism, response, peerName string, err error) {
+	conn, err := srv.Accept()
+	if err != nil {
+		return "", "", "", err
+	}
+	defer conn.Close()
+	go func() {
+		<-srv.closed
+		conn.Close()
+	}()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	tconn := conn.(*tls.Conn)
+	if err := tconn.Handshake(); err != nil {
+		return "", "", "", err
+	}
+	if peers := tconn.ConnectionState().PeerCertificates; len(peers) != 0 {
+		peerName = peers[0].Subject.CommonName
+	}
+
+	br := bufio.NewReader(conn)
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return "", "", peerName, err
+	}
+	if string(header) != "AMQP\x00\x00\x09\x01" {
+		return "", "", peerName, errgo.Newf("bad protocol header %q", header)
+	}
+
+	// connection.start
+	var payload []byte
+	payload = append(payload, 0, 10, 0, 10, 0, 9)
+	payload = append(payload, 0, 0, 0, 0) // no server properties
+	payload = appendLongString(payload, mechanisms)
+	payload = appendLongString(payload, "en_US")
+	frame := []byte{1, 0, 0}
+	frame = append(frame, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(frame[3:], uint32(len(payload)))
+	frame = append(append(frame, payload...), 0xCE)
+	if _, err := conn.Write(frame); err != nil {
+		return "", "", peerName, err
+	}
+
+	// connection.start-ok
+	head := make([]byte, 7)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return "", "", peerName, err
+	}
+	if head[0] != 1 {
+		return "", "", peerName, errgo.Newf("got frame type %d, wanted a method", head[0])
+	}
+	b := make([]byte, binary.BigEndian.Uint32(head[3:])+1)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return "", "", peerName, err
+	}
+	if len(b) < 8 || b[0] != 0 || b[1] != 10 || b[2] != 0 || b[3] != 11 {
+		return "", "", peerName, errgo.Newf("got %q, wanted connection.start-ok", b)
+	}
+	b = b[4:]
+	// client properties
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b)) < 4+n+1 {
+		return "", "", peerName, errgo.New("short start-ok")
+	}
+	b = b[4+n:]
+	if m := int(b[0]); len(b) >= 1+m+4 {
+		mechanism, b = string(b[1:1+m]), b[1+m:]
+	}
+	if n := binary.BigEndian.Uint32(b); uint32(len(b)) >= 4+n {
+		response = string(b[4 : 4+n])
+	}
+	return mechanism, response, peerName, nil
+}
+
+func appendLongString(b []byte, s string) []byte {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(s)))
+	return append(append(b, n[:]...), s...)
+}
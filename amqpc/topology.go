@@ -0,0 +1,208 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/streadway/amqp"
+)
+
+// topology describes the exchanges, queues and bindings to be declared.
+//
+// It can be read from a JSON file like
+//
+//	{"exchanges": [{"name": "scans", "type": "fanout", "durable": true}],
+//	 "queues": [{"name": "ocr", "durable": true, "args": {"x-max-length": 1000}}],
+//	 "bindings": [{"queue": "ocr", "exchange": "scans"}]}
+type topology struct {
+	Exchanges []exchangeDecl `json:"exchanges,omitempty"`
+	Queues    []queueDecl    `json:"queues,omitempty"`
+	Bindings  []bindingDecl  `json:"bindings,omitempty"`
+}
+
+type exchangeDecl struct {
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+	Durable    bool       `json:"durable"`
+	AutoDelete bool       `json:"autoDelete,omitempty"`
+	Internal   bool       `json:"internal,omitempty"`
+	Args       amqp.Table `json:"args,omitempty"`
+}
+
+type queueDecl struct {
+	Name       string     `json:"name"`
+	Durable    bool       `json:"durable"`
+	AutoDelete bool       `json:"autoDelete,omitempty"`
+	Exclusive  bool       `json:"exclusive,omitempty"`
+	Args       amqp.Table `json:"args,omitempty"`
+}
+
+type bindingDecl struct {
+	Queue    string     `json:"queue"`
+	Exchange string     `json:"exchange"`
+	Key      string     `json:"key,omitempty"`
+	Args     amqp.Table `json:"args,omitempty"`
+}
+
+// readTopology reads the topology from the named JSON file.
+func readTopology(fn string) (topology, error) {
+	var t topology
+	fh, err := os.Open(fn)
+	if err != nil {
+		return t, err
+	}
+	defer fh.Close()
+	if err := json.NewDecoder(fh).Decode(&t); err != nil {
+		return t, errgo.Notef(err, "parse %q", fn)
+	}
+	for i := range t.Exchanges {
+		t.Exchanges[i].Args = jsonTable(t.Exchanges[i].Args)
+	}
+	for i := range t.Queues {
+		t.Queues[i].Args = jsonTable(t.Queues[i].Args)
+	}
+	for i := range t.Bindings {
+		t.Bindings[i].Args = jsonTable(t.Bindings[i].Args)
+	}
+	return t, t.Validate()
+}
+
+// Validate checks the exchange types and the arguments.
+func (t topology) Validate() error {
+	for _, e := range t.Exchanges {
+		if err := checkExchangeType(e.Type); err != nil {
+			return errgo.Notef(err, "exchange %q", e.Name)
+		}
+		if err := e.Args.Validate(); err != nil {
+			return errgo.Notef(err, "exchange %q", e.Name)
+		}
+	}
+	for _, q := range t.Queues {
+		if err := q.Args.Validate(); err != nil {
+			return errgo.Notef(err, "queue %q", q.Name)
+		}
+	}
+	for _, b := range t.Bindings {
+		if err := b.Args.Validate(); err != nil {
+			return errgo.Notef(err, "binding %q-%q", b.Exchange, b.Queue)
+		}
+	}
+	return nil
+}
+
+// Declare the topology on ch: first the exchanges, then the queues, then the bindings.
+func (t topology) Declare(ch Channel) error {
+	for _, e := range t.Exchanges {
+		if err := ch.ExchangeDeclare(e.Name, e.Type, e.Durable, e.AutoDelete, e.Internal, false, e.Args); err != nil {
+			return errgo.Notef(err, "ExchangeDeclare(%q)", e.Name)
+		}
+	}
+	for _, q := range t.Queues {
+		if _, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Args); err != nil {
+			return errgo.Notef(err, "QueueDeclare(%q)", q.Name)
+		}
+	}
+	for _, b := range t.Bindings {
+		if err := ch.QueueBind(b.Queue, b.Key, b.Exchange, false, b.Args); err != nil {
+			return errgo.Notef(err, "QueueBind(%q, %q, %q)", b.Queue, b.Key, b.Exchange)
+		}
+	}
+	return nil
+}
+
+func checkExchangeType(typ string) error {
+	switch typ {
+	case amqp.ExchangeDirect, amqp.ExchangeTopic, amqp.ExchangeFanout, amqp.ExchangeHeaders:
+		return nil
+	}
+	return errgo.Newf("unknown exchange type %q (direct, topic, fanout or headers)", typ)
+}
+
+// bindingOf returns the binding of queue to exchange with the given --bind pattern.
+//
+// For headers exchanges, the pattern is a comma separated list of key=value pairs,
+// e.g. "x-match=any,type=scan", which become the binding's arguments.
+func bindingOf(queue, exchange, exchangeType, pattern string) bindingDecl {
+	b := bindingDecl{Queue: queue, Exchange: exchange, Key: pattern}
+	if exchangeType != amqp.ExchangeHeaders {
+		return b
+	}
+	b.Key, b.Args = "", make(amqp.Table)
+	for _, kv := range strings.Split(pattern, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			b.Args[kv] = ""
+			continue
+		}
+		b.Args[kv[:i]] = kv[i+1:]
+	}
+	return b
+}
+
+// defaultBindPattern returns the binding pattern used when no --bind is given:
+// everything for topic exchanges, the queue's name for direct ones.
+func defaultBindPattern(exchangeType, queue string) string {
+	switch exchangeType {
+	case amqp.ExchangeTopic:
+		return "#"
+	case amqp.ExchangeDirect:
+		return queue
+	}
+	return ""
+}
+
+// jsonTable converts the integral numbers JSON decoding leaves as float64 to int64,
+// as the broker wants integers for x-max-length and such.
+// The json.Numbers (of a decoder with UseNumber) are converted to int64 if integral,
+// else to float64: this way even the integers beyond 2^53 are exact.
+func jsonTable(t amqp.Table) amqp.Table {
+	for k, v := range t {
+		t[k] = jsonValue(v)
+	}
+	return t
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case float64:
+		if x == math.Trunc(x) && math.Abs(x) < 1<<53 {
+			return int64(x)
+		}
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		if f, err := x.Float64(); err == nil {
+			return f
+		}
+	case map[string]interface{}:
+		return jsonTable(amqp.Table(x))
+	case []interface{}:
+		for i, e := range x {
+			x[i] = jsonValue(e)
+		}
+	}
+	return v
+}
@@ -0,0 +1,203 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// defaultIgnorePatterns match the partial and temporary files, which watch skips.
+var defaultIgnorePatterns = []string{".*", "*~", "*.tmp", "*.part", "*.partial", "*.crdownload", "*.swp"}
+
+// folderWatcher publishes the files appearing in Dir,
+// then moves them to SentDir, or deletes them if SentDir is empty.
+type folderWatcher struct {
+	Dir, SentDir string
+	// Ignore are the patterns of the file names to skip.
+	Ignore []string
+	Sender sender
+	// Connect returns a new publisher. It is called again
+	// after RetryInterval while the publisher is offline.
+	Connect       func() (*publisher, error)
+	RetryInterval time.Duration
+
+	pb          *publisher
+	lastConnect time.Time
+	// failed are the files whose publishing failed, to be retried.
+	failed map[string]bool
+}
+
+// Run publishes the files already in Dir, then the new ones, till a signal arrives.
+// The failed ones are retried in each RetryInterval.
+func (w *folderWatcher) Run(sigCh <-chan os.Signal) error {
+	w.failed = make(map[string]bool)
+	// start watching before listing, so no file falls between
+	dw, err := newDirWatcher(w.Dir)
+	if err != nil {
+		return err
+	}
+	defer dw.Close()
+	names := make(chan []string)
+	errCh := make(chan error, 1)
+	go func() { errCh <- dw.Watch(names) }()
+	defer func() {
+		if w.pb != nil {
+			w.pb.Close()
+		}
+	}()
+
+	existing, err := listDir(w.Dir)
+	if err != nil {
+		return err
+	}
+	log.Printf("Watching %q, %d files are there already.", w.Dir, len(existing))
+	for _, name := range existing {
+		w.Handle(name)
+	}
+
+	ticker := time.NewTicker(w.RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case batch := <-names:
+			for _, name := range batch {
+				w.Handle(name)
+			}
+		case <-ticker.C:
+			retry := make([]string, 0, len(w.failed))
+			for name := range w.failed {
+				retry = append(retry, name)
+			}
+			sort.Strings(retry)
+			for _, name := range retry {
+				w.Handle(name)
+			}
+		case err := <-errCh:
+			return err
+		case sig := <-sigCh:
+			log.Printf("Got %s, stopping.", sig)
+			return nil
+		}
+	}
+}
+
+// Handle publishes the named file, waits for its confirmation (or spooling),
+// then moves or deletes it.
+func (w *folderWatcher) Handle(name string) {
+	if ignored(name, w.Ignore) {
+		return
+	}
+	path := filepath.Join(w.Dir, name)
+	fi, err := os.Lstat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		// gone, or not a file
+		delete(w.failed, name)
+		return
+	}
+	if w.pb == nil || w.pb.Offline() != nil && time.Since(w.lastConnect) >= w.RetryInterval {
+		if w.pb != nil {
+			w.pb.Close()
+		}
+		w.lastConnect = time.Now()
+		if w.pb, err = w.Connect(); err != nil {
+			log.Printf("Connect: %v", err)
+			w.failed[name] = true
+			return
+		}
+	}
+	w.pb.Begin(path)
+	if err = w.Sender.Send(w.pb, "@"+path); err == nil {
+		err = w.pb.Flush()
+	}
+	res := w.pb.Take(path)
+	if err == nil && res.Status() == "failed" {
+		err = res.Err
+		if err == nil {
+			err = errgo.Newf("%d of %d messages are not delivered (%d returned)", res.Messages-res.Delivered-res.Spooled, res.Messages, res.Returned)
+		}
+	}
+	if err != nil {
+		log.Printf("Publish %q: %v", path, err)
+		w.failed[name] = true
+		return
+	}
+	delete(w.failed, name)
+	if res.Spooled != 0 {
+		log.Printf("%q is spooled.", path)
+	}
+
+	if w.SentDir == "" {
+		if err := os.Remove(path); err != nil {
+			log.Printf("Remove %q: %v", path, err)
+		}
+		return
+	}
+	dest := uniqueName(filepath.Join(w.SentDir, name))
+	if err := os.Rename(path, dest); err != nil {
+		log.Printf("Move %q to %q: %v", path, dest, err)
+	}
+}
+
+// listDir returns the names of the regular files in dir, the oldest first.
+func listDir(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(fis, func(i, j int) bool { return fis[i].ModTime().Before(fis[j].ModTime()) })
+	names := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+// ignored reports whether name matches any of the patterns.
+func ignored(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueName returns fn if it doesn't exist, else fn with a -N suffix
+// (before the extension) which doesn't exist.
+func uniqueName(fn string) string {
+	if _, err := os.Lstat(fn); os.IsNotExist(err) {
+		return fn
+	}
+	ext := filepath.Ext(fn)
+	base := strings.TrimSuffix(fn, ext)
+	for i := 1; ; i++ {
+		cand := fmt.Sprintf("%s-%d%s", base, i, ext)
+		if _, err := os.Lstat(cand); os.IsNotExist(err) {
+			return cand
+		}
+	}
+}
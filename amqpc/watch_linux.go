@@ -0,0 +1,93 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"log"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"gopkg.in/errgo.v1"
+)
+
+// dirWatcher watches a directory with inotify.
+type dirWatcher struct {
+	dir string
+	fd  int
+}
+
+// newDirWatcher starts watching dir for the files closed after writing
+// or moved into it. The events are queued till Watch reads them.
+func newDirWatcher(dir string) (*dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, errgo.Notef(err, "inotify_init")
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO|syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF); err != nil {
+		syscall.Close(fd)
+		return nil, errgo.Notef(err, "inotify_add_watch(%q)", dir)
+	}
+	return &dirWatcher{dir: dir, fd: fd}, nil
+}
+
+// Close stops the watching.
+func (w *dirWatcher) Close() error { return syscall.Close(w.fd) }
+
+// Watch sends the names of the new files to names, till an error occurs.
+// On an inotify queue overflow, the whole directory is listed again.
+func (w *dirWatcher) Watch(names chan<- []string) error {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return errgo.Notef(err, "read inotify events")
+		}
+		var batch []string
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			off += syscall.SizeofInotifyEvent
+			var name string
+			if ev.Len > 0 {
+				name = strings.TrimRight(string(buf[off:off+int(ev.Len)]), "\x00")
+				off += int(ev.Len)
+			}
+			switch {
+			case ev.Mask&syscall.IN_Q_OVERFLOW != 0:
+				log.Printf("inotify queue overflow, rescanning %q.", w.dir)
+				all, err := listDir(w.dir)
+				if err != nil {
+					return err
+				}
+				batch = append(batch, all...)
+			case ev.Mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF|syscall.IN_IGNORED) != 0:
+				return errgo.Newf("%q is gone", w.dir)
+			case ev.Mask&syscall.IN_ISDIR != 0 || name == "":
+			default:
+				batch = append(batch, name)
+			}
+		}
+		if len(batch) != 0 {
+			names <- batch
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "gopkg.in/errgo.v1"
+
+// dirWatcher needs inotify, so it works only on Linux.
+type dirWatcher struct{}
+
+func newDirWatcher(dir string) (*dirWatcher, error) {
+	return nil, errgo.New("watching directories is supported only on Linux")
+}
+
+func (w *dirWatcher) Close() error                      { return nil }
+func (w *dirWatcher) Watch(names chan<- []string) error { return nil }
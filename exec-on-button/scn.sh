@@ -16,5 +16,10 @@ if [ -e $ENVFN ]; then
 	# contains AMQP_USER and AMQP_PASSWORD
 	. $ENVFN
 fi
-/home/pi/bin/amqpc pub --no-compress @$FN.zip
+# Wait for the result of the processing, so the button blinks the error pattern
+# if it failed. The button is busy meanwhile (STOP ends the waiting, the zip is sent
+# already), so the wait is short: a timeout is reported as an error, too, although
+# the processing may still succeed. A spooled zip is not waited for.
+# On error, -e stops here and the zip is kept.
+/home/pi/bin/amqpc pub --no-compress --wait-reply --reply-timeout=2m @$FN.zip
 rm -rf $FN*
@@ -16,6 +16,9 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -27,6 +30,8 @@ import (
 
 	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/spf13/cobra"
+
+	"github.com/tgulacsi/rpi/profile"
 )
 
 var ErrTimeout = errgo.Newf("timeout")
@@ -45,14 +50,61 @@ func main() {
 	p.StringVarP(&server, "server", "S", server, "server address")
 	p.DurationVarP(&timeout, "timeout", "", timeout, "timeout for commands")
 	p.StringVarP(&clientID, "id", "", clientID, "client ID")
+	configFile, profileName := profile.DefaultPath(), os.Getenv("MQTT_PROFILE")
+	p.StringVarP(&configFile, "config", "", configFile, "config file with the broker profiles")
+	p.StringVarP(&profileName, "profile", "", profileName, "broker profile from the config file (default is the file's default one)")
+	var tlsCA, tlsCert, tlsKey, tlsServerName string
+	p.StringVarP(&tlsCA, "tls-ca", "", "", "PEM file of the CA certificates to verify the server with (for an ssl:// server)")
+	p.StringVarP(&tlsCert, "tls-cert", "", "", "PEM file of the client certificate")
+	p.StringVarP(&tlsKey, "tls-key", "", "", "PEM file of the client certificate's key")
+	p.StringVarP(&tlsServerName, "tls-server-name", "", "", "name to verify the server's certificate for, instead of the host")
+
+	// The flags not given are set from the environment, or from the profile.
+	var settings []profile.Setting
+	var user, password string
+	mainCmd.PersistentPreRun = func(cmd *cobra.Command, _ []string) {
+		cfg, err := profile.Load(configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		prof, name, err := cfg.Get(profileName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		profileName = name
+		if err := checkProfile(prof); err != nil {
+			log.Fatal(errgo.Notef(err, "profile %q", name))
+		}
+		if user, password, err = prof.Credentials("MQTT"); err != nil {
+			log.Fatal(err)
+		}
+		settings = []profile.Setting{
+			{Flag: "server", Env: "MQTT_URL", Value: prof.URL},
+			{Flag: "topic", Env: "MQTT_TOPIC", Value: prof.Topic},
+			{Flag: "tls-ca", Env: "MQTT_TLS_CA", Value: prof.TLS.CA},
+			{Flag: "tls-cert", Env: "MQTT_TLS_CERT", Value: prof.TLS.Cert},
+			{Flag: "tls-key", Env: "MQTT_TLS_KEY", Value: prof.TLS.Key},
+			{Flag: "tls-server-name", Env: "MQTT_TLS_SERVER_NAME", Value: prof.TLS.ServerName},
+		}
+		if err := profile.Apply(cmd.Flags(), settings); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	store := "mqtt-store"
 	qos := 1
+	connect := func() (*mqtt.Client, error) {
+		tc, err := tlsConfig(tlsCA, tlsCert, tlsKey, tlsServerName)
+		if err != nil {
+			return nil, err
+		}
+		return newClient(server, clientID, user, password, store, tc, timeout)
+	}
 	pubCmd := &cobra.Command{
 		Use:     "pub",
 		Aliases: []string{"publish", "send", "write"},
 		Run: func(_ *cobra.Command, args []string) {
-			client, err := newClient(server, clientID, store, timeout)
+			client, err := connect()
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -100,7 +152,7 @@ func main() {
 			if len(args) > 0 {
 				topic = args[0]
 			}
-			client, err := newClient(server, clientID, store, timeout)
+			client, err := connect()
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -116,7 +168,20 @@ func main() {
 		},
 	}
 
-	mainCmd.AddCommand(pubCmd, subCmd)
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "configuration commands",
+	}
+	configCmd.AddCommand(&cobra.Command{
+		Use:   "show",
+		Short: "print the effective settings (flag > env > profile > default), with the passwords redacted",
+		Run: func(cmd *cobra.Command, _ []string) {
+			fmt.Printf("%-16s %s\n%-16s %s\n%-16s %s\n", "config", configFile, "profile", profileName, "user", user)
+			profile.Show(os.Stdout, cmd.Flags(), settings)
+		},
+	})
+
+	mainCmd.AddCommand(pubCmd, subCmd, configCmd)
 	mainCmd.Execute()
 }
 
@@ -124,7 +189,59 @@ var msgHandler = mqtt.MessageHandler(func(client *mqtt.Client, msg mqtt.Message)
 	log.Printf("got message from %q (%v): %q", msg.Topic(), msg.MessageID(), msg.Payload())
 })
 
-func newClient(server, clientID, store string, timeout time.Duration) (*mqtt.Client, error) {
+// checkProfile returns an error if prof has settings mqttc does not support,
+// instead of ignoring them silently.
+func checkProfile(prof profile.Profile) error {
+	var names []string
+	if prof.Queue != "" {
+		names = append(names, "queue")
+	}
+	if prof.Compress != "" {
+		names = append(names, "compress")
+	}
+	if prof.SpoolDir != "" {
+		names = append(names, "spool_dir")
+	}
+	if prof.TLS.External {
+		names = append(names, "tls.sasl_external")
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return errgo.Newf("mqttc does not support %s", strings.Join(names, ", "))
+}
+
+// tlsConfig returns the TLS config for the CA, client certificate and server name,
+// or nil if none is given (the system's CAs are used for an ssl:// server then).
+func tlsConfig(ca, cert, key, serverName string) (*tls.Config, error) {
+	if ca == "" && cert == "" && key == "" && serverName == "" {
+		return nil, nil
+	}
+	tc := &tls.Config{ServerName: serverName}
+	if ca != "" {
+		b, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errgo.Newf("no certificates found in %q", ca)
+		}
+	}
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, errgo.New("the client certificate needs both --tls-cert and --tls-key")
+		}
+		c, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, errgo.Notef(err, "load %q and %q", cert, key)
+		}
+		tc.Certificates = []tls.Certificate{c}
+	}
+	return tc, nil
+}
+
+func newClient(server, clientID, user, password, store string, tc *tls.Config, timeout time.Duration) (*mqtt.Client, error) {
 	opts := mqtt.NewClientOptions().
 		AddBroker(server).
 		SetAutoReconnect(true).
@@ -140,6 +257,13 @@ func newClient(server, clientID, store string, timeout time.Duration) (*mqtt.Cli
 	if clientID != "" {
 		opts.SetClientID(clientID)
 	}
+	if user != "" {
+		opts.SetUsername(user)
+		opts.SetPassword(password)
+	}
+	if tc != nil {
+		opts.SetTLSConfig(tc)
+	}
 	if store != "" {
 		opts.SetStore(mqtt.NewFileStore(store))
 	}
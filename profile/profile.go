@@ -0,0 +1,304 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package profile reads the named broker profiles shared by amqpc and mqttc.
+//
+// The config file is $XDG_CONFIG_HOME/rpi/config.toml (~/.config/rpi/config.toml), like
+//
+//	default = "home"
+//
+//	[profile.home]
+//	url = "amqp://192.168.1.3:5672"
+//	credentials_file = "~/.config/rpi/home.env"
+//	queue = "scanner"
+//	compress = "none"
+//
+//	[profile.home-mqtt]
+//	url = "tcp://192.168.1.3:1883"
+//	credentials_file = "~/.config/rpi/home.env"
+//	topic = "buttons"
+//
+//	[profile.office]
+//	url = "amqps://broker.example.com"
+//	[profile.office.tls]
+//	ca = "~/.config/rpi/office-ca.pem"
+//	cert = "~/.config/rpi/office.pem"
+//	key = "~/.config/rpi/office.key"
+//	sasl_external = true
+package profile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/pflag"
+)
+
+// Config is the content of the config file.
+type Config struct {
+	// Default is the name of the profile used when none is selected.
+	Default  string             `toml:"default"`
+	Profiles map[string]Profile `toml:"profile"`
+}
+
+// Profile holds the settings for a broker.
+type Profile struct {
+	URL string `toml:"url"`
+	// CredentialsFile is a shell-style env file, with PREFIX_USER and PREFIX_PASSWORD
+	// (e.g. AMQP_USER and AMQP_PASSWORD) lines, or just USER and PASSWORD.
+	CredentialsFile string `toml:"credentials_file"`
+	Queue           string `toml:"queue"`
+	Topic           string `toml:"topic"`
+	Compress        string `toml:"compress"`
+	SpoolDir        string `toml:"spool_dir"`
+	TLS             TLS    `toml:"tls"`
+}
+
+// TLS holds the TLS settings of a profile.
+type TLS struct {
+	CA         string `toml:"ca"`
+	Cert       string `toml:"cert"`
+	Key        string `toml:"key"`
+	ServerName string `toml:"server_name"`
+	External   bool   `toml:"sasl_external"`
+}
+
+// DefaultPath returns the path of the config file:
+// $XDG_CONFIG_HOME/rpi/config.toml, or ~/.config/rpi/config.toml.
+func DefaultPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(dir, "rpi", "config.toml")
+}
+
+// Load reads the config file fn. A missing file is an empty config.
+//
+// The paths in the profiles are expanded: ~/ means the home directory,
+// and $VARs are replaced from the environment.
+func Load(fn string) (Config, error) {
+	var c Config
+	if _, err := toml.DecodeFile(fn, &c); err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return c, errgo.Notef(err, "parse %q", fn)
+	}
+	for name, p := range c.Profiles {
+		for _, s := range []*string{&p.CredentialsFile, &p.SpoolDir, &p.TLS.CA, &p.TLS.Cert, &p.TLS.Key} {
+			*s = expandPath(*s)
+		}
+		c.Profiles[name] = p
+	}
+	return c, nil
+}
+
+// Get returns the named profile, or the default one if name is empty,
+// and the name of the returned profile.
+//
+// Without a name and a default, the returned profile is empty.
+func (c Config) Get(name string) (Profile, string, error) {
+	if name == "" {
+		if name = c.Default; name == "" {
+			return Profile{}, "", nil
+		}
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		return p, name, errgo.Newf("unknown profile %q", name)
+	}
+	return p, name, nil
+}
+
+// Credentials returns the user and password for prefix (e.g. AMQP):
+// from the PREFIX_USER and PREFIX_PASSWORD environment variables if set,
+// else from the credentials file.
+func (p Profile) Credentials(prefix string) (user, password string, err error) {
+	var env map[string]string
+	if p.CredentialsFile != "" {
+		if env, err = readEnvFile(p.CredentialsFile); err != nil {
+			return "", "", err
+		}
+	}
+	get := func(k string) string {
+		if v := os.Getenv(prefix + "_" + k); v != "" {
+			return v
+		}
+		if v := env[prefix+"_"+k]; v != "" {
+			return v
+		}
+		return env[k]
+	}
+	return get("USER"), get("PASSWORD"), nil
+}
+
+// ServerURL returns the URL of the profile, with the credentials (see Credentials)
+// put into it, unless it has them already.
+func (p Profile) ServerURL(prefix string) (string, error) {
+	if p.URL == "" {
+		return "", nil
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return "", errgo.Notef(err, "parse %q", p.URL)
+	}
+	if u.User != nil {
+		return p.URL, nil
+	}
+	user, password, err := p.Credentials(prefix)
+	if err != nil {
+		return "", err
+	}
+	if user != "" {
+		u.User = url.UserPassword(user, password)
+	}
+	return u.String(), nil
+}
+
+// Setting binds a flag to an environment variable and a profile value.
+type Setting struct {
+	Flag, Env, Value string
+	// Source is where the flag's value comes from: flag, env, profile or default.
+	// Set by Apply.
+	Source string
+}
+
+// Apply sets the flags of fs not given on the command line,
+// from the environment variable if that's set, else from the profile value
+// if that's not empty. So the precedence is flag > env > profile > default.
+//
+// Settings whose flag isn't in fs are skipped.
+func Apply(fs *pflag.FlagSet, settings []Setting) error {
+	for i, s := range settings {
+		f := fs.Lookup(s.Flag)
+		if f == nil {
+			continue
+		}
+		settings[i].Source = "default"
+		if f.Changed {
+			settings[i].Source = "flag"
+			continue
+		}
+		v, source := s.resolve()
+		if v == "" {
+			continue
+		}
+		if err := f.Value.Set(v); err != nil {
+			return errgo.Notef(err, "set --%s from %s to %q", s.Flag, source, Redact(v))
+		}
+		settings[i].Source = source
+	}
+	return nil
+}
+
+// resolve returns the value from the environment or the profile, and its source.
+func (s Setting) resolve() (string, string) {
+	if s.Env != "" {
+		if v := os.Getenv(s.Env); v != "" {
+			return v, "env"
+		}
+	}
+	return s.Value, "profile"
+}
+
+// Show prints the effective values of the settings, and where they come from,
+// with the passwords redacted.
+//
+// The settings of flags not in fs (belonging to other commands) are shown
+// with the value from the environment or the profile, if any.
+func Show(w io.Writer, fs *pflag.FlagSet, settings []Setting) {
+	for _, s := range settings {
+		var v, source string
+		if f := fs.Lookup(s.Flag); f != nil {
+			v, source = f.Value.String(), s.Source
+		} else if v, source = s.resolve(); v == "" {
+			v, source = "(the command's default)", "default"
+		}
+		fmt.Fprintf(w, "%-16s %-8s %s\n", s.Flag, source, Redact(v))
+	}
+}
+
+// Redact returns s with the password replaced, if s is a URL with a password.
+func Redact(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		return s
+	}
+	u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	return u.String()
+}
+
+// readEnvFile reads the KEY=VALUE lines of a shell-style env file.
+// Empty lines, comments and "export " prefixes are allowed, values may be quoted.
+func readEnvFile(fn string) (map[string]string, error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			continue
+		}
+		k, v := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			if v[0] == '"' {
+				if uq, err := strconv.Unquote(v); err == nil {
+					v = uq
+				} else {
+					v = v[1 : len(v)-1]
+				}
+			} else {
+				v = v[1 : len(v)-1]
+			}
+		}
+		env[k] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errgo.Notef(err, "read %q", fn)
+	}
+	return env, nil
+}
+
+func expandPath(s string) string {
+	if s == "" {
+		return s
+	}
+	if s == "~" || strings.HasPrefix(s, "~/") {
+		s = filepath.Join(os.Getenv("HOME"), s[1:])
+	}
+	return os.ExpandEnv(s)
+}